@@ -0,0 +1,357 @@
+// secureShareAdmin - manages a running secureShareServer through its admin API
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/scusi/secureShare/libs/client/askpass"
+	"github.com/scusi/secureShare/libs/server/config"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var Debug bool
+var configFile string
+var listInvites bool
+var createInvite bool
+var revokeInvite string
+var note string
+var ttl time.Duration
+var listUsers bool
+var pendingOnly bool
+var approve string
+var inspect string
+var disable string
+var enable string
+var deleteUser string
+var resetToken string
+var tokenFile string
+var listFiles string
+var purgeFiles string
+var usage bool
+var verify bool
+var yes bool
+
+var cfg *config.Config
+var err error
+
+func init() {
+	flag.BoolVar(&Debug, "debug", false, "enables debug output, when 'true'")
+	flag.StringVar(&configFile, "conf", "config.yml", "config file of the server (yaml)")
+	flag.BoolVar(&listInvites, "list-invites", false, "list the unused invite codes")
+	flag.BoolVar(&createInvite, "create-invite", false, "create a single-use invite code")
+	flag.StringVar(&note, "note", "", "reminder whom an invite is for, used with -create-invite")
+	flag.DurationVar(&ttl, "ttl", 0, "time an invite can be used, used with -create-invite. 0 means no limit")
+	flag.StringVar(&revokeInvite, "revoke-invite", "", "invite code to revoke")
+	flag.BoolVar(&listUsers, "list-users", false, "list the accounts")
+	flag.BoolVar(&pendingOnly, "pending", false, "list only accounts waiting for approval, used with -list-users")
+	flag.StringVar(&approve, "approve", "", "username of a pending account to approve")
+	flag.StringVar(&inspect, "user", "", "username of an account to show in detail")
+	flag.StringVar(&disable, "disable", "", "username of an account to disable, its tokens are refused until it is enabled")
+	flag.StringVar(&enable, "enable", "", "username of a disabled account to enable")
+	flag.StringVar(&deleteUser, "delete", "", "username of an account to delete, along with its files")
+	flag.StringVar(&resetToken, "reset-token", "", "username of an account to replace all tokens of with a new one")
+	flag.StringVar(&tokenFile, "token-file", "apitoken.minilock", "file the new token, encrypted to the user, is written to by -reset-token")
+	flag.StringVar(&listFiles, "list-files", "", "username to list the waiting files of")
+	flag.StringVar(&purgeFiles, "purge-files", "", "username to erase all waiting files of")
+	flag.BoolVar(&usage, "usage", false, "show the storage used per user and in total")
+	flag.BoolVar(&verify, "verify", false, "check users, files and blobs for inconsistencies")
+	flag.BoolVar(&yes, "yes", false, "do not ask for confirmation of -delete and -purge-files")
+}
+
+// Invite is an invite code as sent by the admin API
+type Invite struct {
+	Code    string     `json:"code"`
+	Note    string     `json:"note,omitempty"`
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// UserInfo describes an account as sent by the admin API
+type UserInfo struct {
+	Name     string   `json:"name"`
+	Pending  bool     `json:"pending"`
+	Disabled bool     `json:"disabled"`
+	Tokens   []string `json:"tokens"`
+}
+
+// UserDetails describes a single account as sent by the admin API
+type UserDetails struct {
+	UserInfo
+	PublicKey string `json:"publicKey"`
+	TokenInfo []struct {
+		Name    string    `json:"name"`
+		Created time.Time `json:"created"`
+	} `json:"tokenInfo"`
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// FileInfo describes a file waiting for a user
+type FileInfo struct {
+	FileID     string     `json:"fileID"`
+	Size       int64      `json:"size"`
+	UploadedAt time.Time  `json:"uploadedAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	Sender     string     `json:"sender,omitempty"`
+}
+
+// Usage shows the storage used by all users
+type Usage struct {
+	Users []struct {
+		Name  string `json:"name"`
+		Files int    `json:"files"`
+		Bytes int64  `json:"bytes"`
+	} `json:"users"`
+	Files       int   `json:"files"`
+	Bytes       int64 `json:"bytes"`
+	Blobs       int   `json:"blobs"`
+	StoredBytes int64 `json:"storedBytes"`
+}
+
+// VerifyReport lists the problems the server found in its stores
+type VerifyReport struct {
+	Users    int      `json:"users"`
+	Files    int      `json:"files"`
+	Blobs    int      `json:"blobs"`
+	Problems []string `json:"problems"`
+}
+
+func checkFatal(err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// rawResponse is a response of the admin API as it is
+type rawResponse struct {
+	ContentType string
+	Body        []byte
+}
+
+// adminRequest sends a request to the admin API of the server and decodes
+// a JSON response into v. A *string or *rawResponse v gets the response as
+// it is, nil ignores the response.
+func adminRequest(method, path string, form url.Values, v interface{}) (err error) {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, "http://"+cfg.AdminListenAddr+path, body)
+	if err != nil {
+		return
+	}
+	if form != nil {
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.Header.Add("Admintoken", cfg.AdminToken)
+	if Debug {
+		log.Printf("%s %s\n", method, req.URL)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case *string:
+		*v = string(respBody)
+		return nil
+	case *rawResponse:
+		v.ContentType = resp.Header.Get("Content-Type")
+		v.Body = respBody
+		return nil
+	}
+	return json.Unmarshal(respBody, v)
+}
+
+// tokenContentType is the media type of a minilock encrypted API token
+const tokenContentType = "application/x-minilock"
+
+// userPath returns the admin API path of an account
+func userPath(username string) string {
+	return "/users/" + url.PathEscape(username)
+}
+
+func status(u UserInfo) string {
+	switch {
+	case u.Disabled:
+		return "disabled"
+	case u.Pending:
+		return "pending"
+	}
+	return "active"
+}
+
+func printInvite(i Invite) {
+	expires := "never"
+	if i.Expires != nil {
+		expires = i.Expires.Format(time.RFC3339)
+	}
+	fmt.Printf("%s\tcreated: %s\texpires: %s\t%s\n", i.Code, i.Created.Format(time.RFC3339), expires, i.Note)
+}
+
+func main() {
+	flag.Parse()
+	cfg, err = config.ReadFromFile(configFile)
+	checkFatal(err)
+	if cfg.AdminListenAddr == "" || cfg.AdminToken == "" {
+		log.Fatalf("the admin API is disabled, set adminlistenaddr and admintoken in '%s'\n", configFile)
+	}
+
+	if createInvite {
+		form := url.Values{}
+		form.Add("note", note)
+		if ttl > 0 {
+			form.Add("ttl", ttl.String())
+		}
+		var i Invite
+		err = adminRequest("POST", "/invites", form, &i)
+		checkFatal(err)
+		printInvite(i)
+	}
+
+	if revokeInvite != "" {
+		err = adminRequest("DELETE", "/invites/"+url.PathEscape(revokeInvite), nil, nil)
+		checkFatal(err)
+		log.Printf("invite '%s' revoked\n", revokeInvite)
+	}
+
+	if listInvites {
+		var list []Invite
+		err = adminRequest("GET", "/invites", nil, &list)
+		checkFatal(err)
+		for _, i := range list {
+			printInvite(i)
+		}
+	}
+
+	if approve != "" {
+		err = adminRequest("POST", userPath(approve)+"/approve", nil, nil)
+		checkFatal(err)
+		log.Printf("user '%s' approved\n", approve)
+	}
+
+	if disable != "" {
+		err = adminRequest("POST", userPath(disable)+"/disable", nil, nil)
+		checkFatal(err)
+		log.Printf("user '%s' disabled\n", disable)
+	}
+
+	if enable != "" {
+		err = adminRequest("POST", userPath(enable)+"/enable", nil, nil)
+		checkFatal(err)
+		log.Printf("user '%s' enabled\n", enable)
+	}
+
+	if resetToken != "" {
+		var token rawResponse
+		err = adminRequest("POST", userPath(resetToken)+"/reset-token", nil, &token)
+		checkFatal(err)
+		if strings.HasPrefix(token.ContentType, tokenContentType) {
+			// only the user can decrypt it
+			err = ioutil.WriteFile(tokenFile, token.Body, 0600)
+			checkFatal(err)
+			fmt.Printf("new APIToken for '%s' written to '%s', encrypted to the user.\n", resetToken, tokenFile)
+			fmt.Printf("hand it to the user, who imports it with 'secureShare -import-token %s'\n", tokenFile)
+		} else {
+			fmt.Printf("new APIToken for '%s': %s\n", resetToken, token.Body)
+		}
+	}
+
+	if purgeFiles != "" {
+		if yes || askpass.Confirm(fmt.Sprintf("Erase all files waiting for '%s'?", purgeFiles)) {
+			var count string
+			err = adminRequest("DELETE", userPath(purgeFiles)+"/files", nil, &count)
+			checkFatal(err)
+			log.Printf("%s files of '%s' erased\n", count, purgeFiles)
+		}
+	}
+
+	if deleteUser != "" {
+		if yes || askpass.Confirm(fmt.Sprintf("Delete the account '%s' and all its files?", deleteUser)) {
+			err = adminRequest("DELETE", userPath(deleteUser), nil, nil)
+			checkFatal(err)
+			log.Printf("user '%s' deleted\n", deleteUser)
+		}
+	}
+
+	if inspect != "" {
+		var u UserDetails
+		err = adminRequest("GET", userPath(inspect), nil, &u)
+		checkFatal(err)
+		fmt.Printf("name:      %s\n", u.Name)
+		fmt.Printf("status:    %s\n", status(u.UserInfo))
+		fmt.Printf("publicKey: %s\n", u.PublicKey)
+		fmt.Printf("files:     %d (%d byte)\n", u.Files, u.Bytes)
+		for _, t := range u.TokenInfo {
+			fmt.Printf("token:     %s (created %s)\n", t.Name, t.Created.Format(time.RFC3339))
+		}
+	}
+
+	if listFiles != "" {
+		var list []FileInfo
+		err = adminRequest("GET", userPath(listFiles)+"/files", nil, &list)
+		checkFatal(err)
+		for _, f := range list {
+			expires := "never"
+			if f.ExpiresAt != nil {
+				expires = f.ExpiresAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%s\t%d\tuploaded: %s\texpires: %s\tsender: %s\n",
+				f.FileID, f.Size, f.UploadedAt.Format(time.RFC3339), expires, f.Sender)
+		}
+	}
+
+	if listUsers {
+		path := "/users"
+		if pendingOnly {
+			path += "?pending=true"
+		}
+		var list []UserInfo
+		err = adminRequest("GET", path, nil, &list)
+		checkFatal(err)
+		for _, u := range list {
+			fmt.Printf("%s\t%s\ttokens: %s\n", u.Name, status(u), strings.Join(u.Tokens, ","))
+		}
+	}
+
+	if usage {
+		var u Usage
+		err = adminRequest("GET", "/usage", nil, &u)
+		checkFatal(err)
+		for _, user := range u.Users {
+			fmt.Printf("%s\t%d files\t%d byte\n", user.Name, user.Files, user.Bytes)
+		}
+		fmt.Printf("total: %d files, %d byte for all recipients\n", u.Files, u.Bytes)
+		fmt.Printf("stored: %d blobs, %d byte\n", u.Blobs, u.StoredBytes)
+	}
+
+	if verify {
+		var report VerifyReport
+		err = adminRequest("GET", "/verify", nil, &report)
+		checkFatal(err)
+		fmt.Printf("checked %d users, %d files and %d blobs\n", report.Users, report.Files, report.Blobs)
+		for _, p := range report.Problems {
+			fmt.Printf("PROBLEM: %s\n", p)
+		}
+		if len(report.Problems) > 0 {
+			log.Fatalf("%d problems found\n", len(report.Problems))
+		}
+	}
+}
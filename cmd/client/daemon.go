@@ -0,0 +1,250 @@
+// daemon - receives arriving files into a drop folder
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/scusi/secureShare/libs/client"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// unknownSenderDir is the directory below the inbox files of senders that
+// are not in the addressbook are saved in, if they are accepted at all.
+const unknownSenderDir = "unknown"
+
+// daemon receives the files waiting for the user into inbox, every sender
+// gets a directory named by the alias in the addressbook.
+type daemon struct {
+	c             *client.Client
+	inbox         string
+	acceptUnknown bool            // save files of unknown senders too
+	done          map[string]bool // fileIDs received or left on the server
+}
+
+// runDaemon receives files until it is interrupted. Arriving files are
+// announced by the server, the inbox is checked every pollInterval as well,
+// for files that could not be received before and for servers that do not
+// support events.
+func runDaemon(c *client.Client, inbox string, acceptUnknown bool, pollInterval time.Duration) (err error) {
+	err = os.MkdirAll(inbox, 0700)
+	if err != nil {
+		return
+	}
+	d := &daemon{c: c, inbox: inbox, acceptUnknown: acceptUnknown, done: make(map[string]bool)}
+	ctx, cancel := interruptContext()
+	defer cancel()
+	log.Printf("receiving files into '%s'\n", inbox)
+	// subscribe first, files arriving while the waiting ones are received
+	// are announced then
+	events, err := c.Watch(ctx)
+	if se, ok := err.(*client.StatusError); ok && se.StatusCode == 404 {
+		log.Printf("server sends no events, polling every %s\n", pollInterval)
+		return d.poll(ctx, pollInterval)
+	}
+	if err != nil {
+		return
+	}
+	err = d.receiveWaiting()
+	if err != nil {
+		log.Printf("ERROR listing files: %s\n", err.Error())
+	}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if e.Type == client.EventNewFile {
+				d.receive(e.FileID, e.Sender)
+			}
+		case <-ticker.C:
+			err = d.receiveWaiting()
+			if err != nil {
+				log.Printf("ERROR listing files: %s\n", err.Error())
+			}
+		}
+	}
+}
+
+// interruptContext returns a context that is done once the program is
+// interrupted or terminated.
+func interruptContext() (ctx context.Context, cancel context.CancelFunc) {
+	ctx, cancel = context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-interrupt:
+			log.Printf("stopping\n")
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(interrupt)
+	}()
+	return
+}
+
+// poll receives the waiting files every interval until ctx is done
+func (d *daemon) poll(ctx context.Context, interval time.Duration) (err error) {
+	for {
+		err = d.receiveWaiting()
+		if err != nil {
+			log.Printf("ERROR listing files: %s\n", err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// receiveWaiting receives all files waiting on the server
+func (d *daemon) receiveWaiting() (err error) {
+	files, err := d.c.List()
+	if err != nil {
+		return
+	}
+	for _, fi := range files {
+		d.receive(fi.FileID, fi.Sender)
+	}
+	return nil
+}
+
+// receive downloads and decrypts a file, verifies the sender against the
+// addressbook and saves the file in the directory of the sender. sender is
+// the username the server names, it is only used for warnings. Files of
+// unknown senders are left on the server unless d.acceptUnknown is set.
+func (d *daemon) receive(fileID, sender string) {
+	if d.done[fileID] {
+		return
+	}
+	f, err := d.c.Receive(fileID)
+	if err != nil {
+		log.Printf("ERROR receiving '%s': %s\n", fileID, err.Error())
+		return
+	}
+	// reload, contacts may have been added since the daemon started
+	a, err := d.c.LoadAddressbook()
+	if err != nil {
+		log.Printf("ERROR loading addressbook: %s\n", err.Error())
+		return
+	}
+	alias := a.AliasByPubkey(f.SenderID)
+	dir := safeName(alias)
+	switch {
+	case alias == "" && !d.acceptUnknown:
+		log.Printf("WARNING: '%s' is from '%s', who is not in the addressbook, left on the server\n", fileID, f.SenderID)
+		d.done[fileID] = true
+		return
+	case alias == "":
+		log.Printf("WARNING: '%s' is from '%s', who is not in the addressbook\n", fileID, f.SenderID)
+		dir = filepath.Join(unknownSenderDir, f.SenderID)
+	case dir == "":
+		dir = f.SenderID
+	}
+	if name := a.NameByAlias(alias); alias != "" && sender != "" && sender != name {
+		log.Printf("WARNING: server names '%s' as sender of '%s', but it was sent by '%s'\n", sender, fileID, alias)
+	}
+	filename := safeName(f.Filename)
+	if filename == "" {
+		filename = fileID
+	}
+	path, err := saveUnique(filepath.Join(d.inbox, dir), filename, f.Content)
+	if err != nil {
+		log.Printf("ERROR saving '%s': %s\n", fileID, err.Error())
+		return
+	}
+	err = d.c.Acknowledge(fileID)
+	if err != nil {
+		log.Printf("ERROR acknowledging '%s': %s\n", fileID, err.Error())
+	}
+	d.done[fileID] = true
+	log.Printf("fileID '%s' written to '%s'\n", fileID, path)
+}
+
+// safeName strips the path from a name given by a sender, it returns an
+// empty string if nothing usable is left.
+func safeName(name string) string {
+	name = filepath.Base(filepath.FromSlash(strings.Replace(name, "\\", "/", -1)))
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return ""
+	}
+	return name
+}
+
+// saveUnique writes data to a new file called name in dir. If the name is
+// taken a number is added, like 'report (1).pdf'. The file shows up only
+// once it is complete.
+func saveUnique(dir, name string, data []byte) (path string, err error) {
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return
+	}
+	tmp, err := ioutil.TempFile(dir, ".secureshare-")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if errClose := tmp.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return
+	}
+	return linkUnique(tmp.Name(), dir, name)
+}
+
+// linkUnique links the file src into dir under name, or under a numbered
+// variant of name if it is taken. Unlike rename, link does not replace an
+// existing file. Where hard links are not possible, like across devices,
+// src is copied instead.
+func linkUnique(src, dir, name string) (path string, err error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; ; i++ {
+		path = filepath.Join(dir, name)
+		if i > 0 {
+			path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+		}
+		err = os.Link(src, path)
+		if err != nil && !os.IsExist(err) {
+			err = copyNew(src, path)
+		}
+		if !os.IsExist(err) {
+			return
+		}
+	}
+}
+
+// copyNew copies the file src to dst, which must not exist yet
+func copyNew(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(out, in)
+	if errClose := out.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return
+}
@@ -2,6 +2,7 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/tls"
 	"encoding/base64"
@@ -23,6 +24,7 @@ import (
 	"os/user"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 var defClientConfigFile string
@@ -46,6 +48,24 @@ var deleteContact bool
 var saltHex string // submit salt to register process
 var showUsername bool
 var toraddr string
+var ttl time.Duration
+var listTokens bool
+var createToken string
+var revokeToken string
+var rotateToken bool
+var importToken string
+var serverKey string
+var unregister bool
+var invite string
+var usage bool
+var watch bool
+var autoDownload bool
+var daemonMode bool
+var inbox string
+var acceptUnknown bool
+var pollInterval time.Duration
+var outboxDir string
+var sentDir string
 
 func init() {
 	flag.StringVar(&toraddr, "socksproxy", "", "set a socks proxy (e.g. tor) to be used to connect to the server")
@@ -71,6 +91,24 @@ func init() {
 	flag.BoolVar(&deleteContact, "delete-contact", false, "removes given alias from the addressbook")
 	flag.StringVar(&saltHex, "salt", "", "provide the salt value to the register process (DO NOT USE unless you know what you do)")
 	flag.BoolVar(&showUsername, "show-user", false, "prints your secureShare Username")
+	flag.DurationVar(&ttl, "ttl", 0, "time the server should keep a sent file (e.g. 24h), server default if not set")
+	flag.BoolVar(&listTokens, "list-tokens", false, "list the API tokens of your account")
+	flag.StringVar(&createToken, "create-token", "", "create a new API token with the given name, e.g. for another device")
+	flag.StringVar(&revokeToken, "revoke-token", "", "revoke the API token with the given name")
+	flag.BoolVar(&unregister, "unregister", false, "delete your secureShare account, including waiting files and the local config")
+	flag.StringVar(&invite, "invite", "", "invite code, used with -register on servers that only accept invited users")
+	flag.StringVar(&serverKey, "server-key", "", "minilock ID of the server, used with -register to verify the API token")
+	flag.BoolVar(&rotateToken, "rotate-token", false, "replace the API token of this client with a new one")
+	flag.StringVar(&importToken, "import-token", "", "file with an encrypted API token from the server admin to use from now on")
+	flag.BoolVar(&usage, "usage", false, "show the storage you use on the server and its limits")
+	flag.BoolVar(&watch, "watch", false, "wait for files to arrive and print them, until interrupted")
+	flag.BoolVar(&autoDownload, "auto-download", false, "used with -watch, receive arriving files into the current directory")
+	flag.BoolVar(&daemonMode, "daemon", false, "keep running and receive arriving files into the -inbox directory")
+	flag.StringVar(&inbox, "inbox", filepath.Join(usr.HomeDir, "Incoming"), "directory -daemon saves files in, one subdirectory per sender")
+	flag.BoolVar(&acceptUnknown, "accept-unknown", false, "used with -daemon, also receive files of senders not in the addressbook")
+	flag.DurationVar(&pollInterval, "poll-interval", time.Minute, "used with -daemon or -outbox, interval the inbox or outbox is checked in")
+	flag.StringVar(&outboxDir, "outbox", "", "keep running and send files dropped into <outbox>/<alias>/ to that contact")
+	flag.StringVar(&sentDir, "sent", "", "used with -outbox, directory sent files are moved to, 'sent' next to the outbox if not set")
 }
 
 func checkFatal(err error) {
@@ -79,6 +117,28 @@ func checkFatal(err error) {
 	}
 }
 
+// receiveFile downloads and decrypts the file with the given fileID and
+// writes it to the current directory
+func receiveFile(c *client.Client, fileID string) (filename string, err error) {
+	filename, data, err := c.DownloadFile(fileID)
+	if err != nil {
+		return
+	}
+	// make sure filename contains no path
+	filename = filepath.Base(filename)
+	err = ioutil.WriteFile(filename, data, 0700)
+	return
+}
+
+// saveConfig writes the client config back to the config file
+func saveConfig(c *client.Client) (err error) {
+	cy, err := yaml.Marshal(c)
+	if err != nil {
+		return
+	}
+	return ioutil.WriteFile(clientConfigFile, cy, 0700)
+}
+
 func main() {
 	flag.Parse()
 
@@ -115,6 +175,7 @@ func main() {
 			client.SetUsername(username),
 			client.SetKeys(keys),
 			client.SetURL(URL),
+			client.SetServerKey(serverKey),
 			//client.SetAPIToken(token),
 		)
 		checkFatal(err)
@@ -132,9 +193,16 @@ func main() {
 			c.SetHttpClient(&http.Client{Transport: tr})
 
 		}
-		// TODO: what do we do against exhausting attacks and similar
-		//       somehow we need to make it ...
-		token, err := c.Register(username, pubID)
+		// learn and pin the identity of the server
+		_, err = c.Identify()
+		if err == client.ErrNoIdentity {
+			log.Printf("WARNING: server has no identity, it can not be verified\n")
+		} else {
+			checkFatal(err)
+		}
+		// servers can limit registrations to invited users or have
+		// new accounts approved by an admin, see RegistrationMode
+		token, err := c.RegisterWithInvite(username, pubID, invite)
 		checkFatal(err)
 		c.APIToken = token
 
@@ -236,6 +304,16 @@ func main() {
 	if addContact != "" {
 		// add contact
 		a.AddEntry(addContact, alias)
+		// pin the server identity on first use, lookups are verified with it
+		if c.ServerFingerprint == "" {
+			_, err = c.Identify()
+			if err == nil {
+				err = saveConfig(&c)
+			}
+			if err != nil && err != client.ErrNoIdentity {
+				checkFatal(err)
+			}
+		}
 		pubKey, err := c.UpdateKey(addContact)
 		checkFatal(err)
 		log.Printf("updatedPubKey: %s\n", pubKey)
@@ -265,8 +343,111 @@ func main() {
 	if list {
 		fileList, err := c.List()
 		checkFatal(err)
-		fmt.Printf("fileID  size\t time\n")
-		fmt.Printf("%s", fileList)
+		fmt.Printf("fileID  size\t uploaded\t expires\t sender\n")
+		for _, fi := range fileList {
+			uploaded, expires := "-", "never"
+			if !fi.UploadedAt.IsZero() {
+				uploaded = fi.UploadedAt.Local().Format(time.RFC822)
+			}
+			if !fi.ExpiresAt.IsZero() {
+				expires = fi.ExpiresAt.Local().Format(time.RFC822)
+			}
+			sender := fi.Sender
+			if alias := a.AliasByName(sender); alias != "" {
+				sender = alias
+			}
+			fmt.Printf("%s  %d\t %s\t %s\t %s\n", fi.FileID, fi.Size, uploaded, expires, sender)
+		}
+		return
+	}
+
+	// delete my secureShare account
+	if unregister {
+		if !askpass.Confirm(fmt.Sprintf("Delete account '%s' and all files waiting for it?", c.Username)) {
+			log.Printf("account not deleted\n")
+			return
+		}
+		err = c.DeleteAccount()
+		checkFatal(err)
+		log.Printf("account '%s' deleted\n", c.Username)
+		userConfigDir := filepath.Join(usr.HomeDir, ".config", "secureshare", "client", c.Username)
+		// remove the default config link, if it points to this account
+		if target, err := os.Readlink(defClientConfigFile); err == nil && filepath.Dir(target) == userConfigDir {
+			err = os.Remove(defClientConfigFile)
+			if err != nil {
+				log.Printf("WARNING: %s\n", err.Error())
+			}
+		}
+		err = os.RemoveAll(userConfigDir)
+		checkFatal(err)
+		log.Printf("removed local config '%s'\n", userConfigDir)
+		return
+	}
+
+	// show how much of the server limits is used
+	if usage {
+		u, err := c.Usage()
+		checkFatal(err)
+		limit := func(n int64) string {
+			if n <= 0 {
+				return "no limit"
+			}
+			return fmt.Sprintf("%d byte", n)
+		}
+		maxFiles := "no limit"
+		if u.InboxMaxFiles > 0 {
+			maxFiles = fmt.Sprintf("%d", u.InboxMaxFiles)
+		}
+		fmt.Printf("files waiting:   %d of %s\n", u.Files, maxFiles)
+		fmt.Printf("inbox size:      %d byte of %s\n", u.Bytes, limit(u.InboxQuota))
+		fmt.Printf("sent today:      %d byte of %s\n", u.SentToday, limit(u.DailyUploadLimit))
+		fmt.Printf("max upload size: %s\n", limit(u.MaxUploadSize))
+		return
+	}
+
+	// manage the API tokens of my secureShare account
+	if listTokens {
+		tokens, err := c.ListTokens()
+		checkFatal(err)
+		fmt.Printf("name\t created\n")
+		for _, t := range tokens {
+			current := ""
+			if t.Current {
+				current = " (this client)"
+			}
+			fmt.Printf("%s\t %s%s\n", t.Name, t.Created.Local().Format(time.RFC822), current)
+		}
+		return
+	}
+	if createToken != "" {
+		token, err := c.CreateToken(createToken)
+		checkFatal(err)
+		fmt.Printf("API token '%s': %s\n", createToken, token)
+		fmt.Printf("set it as 'apitoken' in the client config of your other device.\n")
+		return
+	}
+	if revokeToken != "" {
+		err = c.RevokeToken(revokeToken)
+		checkFatal(err)
+		log.Printf("API token '%s' revoked\n", revokeToken)
+		return
+	}
+	if rotateToken {
+		_, err = c.RotateToken("")
+		checkFatal(err)
+		err = saveConfig(&c)
+		checkFatal(err)
+		log.Printf("API token rotated, saved to '%s'\n", clientConfigFile)
+		return
+	}
+	if importToken != "" {
+		data, err := ioutil.ReadFile(importToken)
+		checkFatal(err)
+		err = c.ImportToken(data)
+		checkFatal(err)
+		err = saveConfig(&c)
+		checkFatal(err)
+		log.Printf("API token imported, saved to '%s'\n", clientConfigFile)
 		return
 	}
 
@@ -326,7 +507,10 @@ func main() {
 		if Debug {
 			client.Debug = true
 		}
-		fileID, err = c.UploadFile(recipientNamesString, encryptedContent)
+		if ttl > 0 {
+			c.TTL = ttl
+		}
+		fileID, err = c.UploadResumable(recipientNamesString, bytes.NewReader(encryptedContent))
 		checkFatal(err)
 		log.Printf("file was uploaded for user '%s' with fileID: '%s'\n", recipient, fileID)
 		return
@@ -334,14 +518,58 @@ func main() {
 
 	// receive a file by it's fileID
 	if fileID != "" {
-		filename, data, err := c.DownloadFile(fileID)
-		if err != nil {
-			checkFatal(err)
-		}
-		// make sure filename contains no path
-		filename = filepath.Base(filename)
-		err = ioutil.WriteFile(filename, data, 0700)
+		filename, err := receiveFile(&c, fileID)
 		checkFatal(err)
 		log.Printf("fileID '%s' written to '%s'\n", fileID, filename)
 	}
+
+	// receive arriving files into the inbox directory
+	if daemonMode {
+		err = runDaemon(&c, inbox, acceptUnknown, pollInterval)
+		checkFatal(err)
+		return
+	}
+
+	// send files dropped into the outbox directory
+	if outboxDir != "" {
+		if sentDir == "" {
+			sentDir = filepath.Join(filepath.Dir(filepath.Clean(outboxDir)), "sent")
+		}
+		if ttl > 0 {
+			c.TTL = ttl
+		}
+		err = runOutbox(&c, outboxDir, sentDir, pollInterval)
+		checkFatal(err)
+		return
+	}
+
+	// wait for files to arrive
+	if watch {
+		ctx, cancel := interruptContext()
+		defer cancel()
+		events, err := c.Watch(ctx)
+		checkFatal(err)
+		log.Printf("waiting for files, press Ctrl-C to stop\n")
+		for e := range events {
+			sender := e.Sender
+			if alias := a.AliasByName(sender); alias != "" {
+				sender = alias
+			}
+			switch e.Type {
+			case client.EventNewFile:
+				fmt.Printf("new file  %s  %d\t %s\n", e.FileID, e.Size, sender)
+				if !autoDownload {
+					continue
+				}
+				filename, err := receiveFile(&c, e.FileID)
+				if err != nil {
+					log.Printf("ERROR receiving '%s': %s\n", e.FileID, err.Error())
+					continue
+				}
+				log.Printf("fileID '%s' written to '%s'\n", e.FileID, filename)
+			case client.EventExpired:
+				fmt.Printf("expired   %s\n", e.FileID)
+			}
+		}
+	}
 }
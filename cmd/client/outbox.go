@@ -0,0 +1,232 @@
+// outbox - sends files dropped into a folder per contact
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cathalgarvey/go-minilock"
+	"github.com/cathalgarvey/go-minilock/taber"
+	"github.com/scusi/secureShare/libs/client"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// settleTime is the time a file found by scanning the outbox must not have
+// been modified, so it is not sent while it is still being written.
+const settleTime = 10 * time.Second
+
+// receiptSuffix is appended to the name of a sent file for its receipt
+const receiptSuffix = ".receipt"
+
+// errNoWatch is returned by watchOutbox if the outbox can only be polled
+var errNoWatch = errors.New("watching directories is not supported on this system")
+
+// Receipt is written next to a sent file
+type Receipt struct {
+	File      string    // name of the file
+	Recipient string    // alias of the recipient
+	Username  string    // secureShare username of the recipient
+	FileID    string    // fileID the recipient receives the file with
+	Size      int64     // size of the file, before encryption
+	Sent      time.Time // time the upload finished
+}
+
+// outbox sends the files in dir/<alias>/ to the contact with that alias
+// and moves them to sent/<alias>/ afterwards.
+type outbox struct {
+	c    *client.Client
+	dir  string
+	sent string
+	kept map[string]time.Time // sent files that could not be moved, by modification time
+	errs map[string]string    // last error sending a file, it is not logged again
+}
+
+// runOutbox sends files dropped into the outbox until it is interrupted.
+// New files are noticed right away where the system supports it, the
+// outbox is scanned every pollInterval as well.
+func runOutbox(c *client.Client, dir, sent string, pollInterval time.Duration) (err error) {
+	for _, d := range []string{dir, sent} {
+		err = os.MkdirAll(d, 0700)
+		if err != nil {
+			return
+		}
+	}
+	o := &outbox{c: c, dir: dir, sent: sent, kept: make(map[string]time.Time), errs: make(map[string]string)}
+	ctx, cancel := interruptContext()
+	defer cancel()
+	ready, err := watchOutbox(ctx, dir)
+	if err != nil {
+		log.Printf("WARNING: %s, checking every %s\n", err.Error(), pollInterval)
+	}
+	log.Printf("sending files dropped into '%s/<alias>'\n", dir)
+	o.scan()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case path, ok := <-ready:
+			if !ok {
+				ready = nil
+				continue
+			}
+			o.send(path)
+		case <-ticker.C:
+			o.scan()
+		}
+	}
+}
+
+// scan sends the files in the outbox that were not modified for settleTime
+func (o *outbox) scan() {
+	aliases, err := ioutil.ReadDir(o.dir)
+	if err != nil {
+		log.Printf("ERROR reading outbox: %s\n", err.Error())
+		return
+	}
+	for _, alias := range aliases {
+		if !alias.IsDir() || o.isSent(alias.Name()) {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(o.dir, alias.Name()))
+		if err != nil {
+			log.Printf("ERROR reading outbox: %s\n", err.Error())
+			continue
+		}
+		for _, fi := range files {
+			if time.Since(fi.ModTime()) < settleTime {
+				continue
+			}
+			o.send(filepath.Join(o.dir, alias.Name(), fi.Name()))
+		}
+	}
+}
+
+// isSent reports whether the directory alias of the outbox is the sent
+// folder, which may be kept within the outbox.
+func (o *outbox) isSent(alias string) bool {
+	dir, err := filepath.Abs(filepath.Join(o.dir, alias))
+	if err != nil {
+		return false
+	}
+	sent, err := filepath.Abs(o.sent)
+	return err == nil && dir == sent
+}
+
+// send encrypts the file at path for the contact named by its directory,
+// uploads it and moves it to the sent folder along with a receipt. Hidden
+// files are skipped, they are often temporary files of other programs.
+func (o *outbox) send(path string) {
+	alias := filepath.Base(filepath.Dir(path))
+	name := filepath.Base(path)
+	if strings.HasPrefix(name, ".") || o.isSent(alias) {
+		return
+	}
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		// sent already
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR sending '%s': %s\n", path, err.Error())
+		return
+	}
+	if !fi.Mode().IsRegular() {
+		return
+	}
+	if modTime, ok := o.kept[path]; ok && modTime.Equal(fi.ModTime()) {
+		return
+	}
+	receipt, err := o.upload(path, alias)
+	if err != nil {
+		if o.errs[path] != err.Error() {
+			log.Printf("ERROR sending '%s': %s\n", path, err.Error())
+			o.errs[path] = err.Error()
+		}
+		return
+	}
+	delete(o.errs, path)
+	log.Printf("'%s' sent to '%s', fileID: %s\n", path, alias, receipt.FileID)
+	sentPath, err := o.moveToSent(path, alias)
+	if err != nil {
+		// do not send it again, unless it is changed
+		log.Printf("ERROR moving '%s' to the sent folder: %s\n", path, err.Error())
+		o.kept[path] = fi.ModTime()
+		if sentPath == "" {
+			sentPath = filepath.Join(o.sent, alias, name)
+		}
+	}
+	data, err := yaml.Marshal(receipt)
+	if err == nil {
+		err = ioutil.WriteFile(sentPath+receiptSuffix, data, 0600)
+	}
+	if err != nil {
+		log.Printf("ERROR writing receipt for '%s': %s\n", path, err.Error())
+	}
+}
+
+// upload encrypts the file at path for the contact with the given alias
+// and uploads it.
+func (o *outbox) upload(path, alias string) (receipt *Receipt, err error) {
+	// reload, contacts may have been added since the outbox was started
+	a, err := o.c.LoadAddressbook()
+	if err != nil {
+		return
+	}
+	username := a.NameByAlias(alias)
+	if username == "" {
+		return nil, fmt.Errorf("'%s' is not in the addressbook", alias)
+	}
+	pubKey := a.PubkeyByAlias(alias)
+	if pubKey == "" {
+		pubKey, err = o.c.UpdateKey(username)
+		if err != nil {
+			return
+		}
+	}
+	recipientKey, err := taber.FromID(pubKey)
+	if err != nil {
+		return
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	encryptedContent, err := minilock.EncryptFileContents(filepath.Base(path), data, o.c.Keys, recipientKey)
+	if err != nil {
+		return
+	}
+	fileID, err := o.c.UploadFile(username, encryptedContent)
+	if err != nil {
+		return
+	}
+	return &Receipt{
+		File:      filepath.Base(path),
+		Recipient: alias,
+		Username:  username,
+		FileID:    fileID,
+		Size:      int64(len(data)),
+		Sent:      time.Now(),
+	}, nil
+}
+
+// moveToSent moves a sent file to the directory of the alias in the sent
+// folder, under a name that is not taken yet.
+func (o *outbox) moveToSent(path, alias string) (sentPath string, err error) {
+	dir := filepath.Join(o.sent, alias)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return
+	}
+	sentPath, err = linkUnique(path, dir, filepath.Base(path))
+	if err != nil {
+		return
+	}
+	return sentPath, os.Remove(path)
+}
@@ -0,0 +1,131 @@
+//go:build linux
+// +build linux
+
+// outbox watching - inotify tells about files dropped into the outbox
+package main
+
+import (
+	"context"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+)
+
+// watch masks of the outbox and of the alias directories in it
+const (
+	outboxMask = unix.IN_CREATE | unix.IN_MOVED_TO | unix.IN_ONLYDIR
+	aliasMask  = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_ONLYDIR
+)
+
+// inotify watches the outbox and its alias directories
+type inotify struct {
+	file *os.File
+	root string
+	dirs map[int]string // watched directories by watch descriptor
+}
+
+// watchOutbox reports the files that were written to, or moved into, an
+// alias directory of the outbox. The channel is closed when ctx is done.
+func watchOutbox(ctx context.Context, dir string) (ready <-chan string, err error) {
+	fd, err := unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		return
+	}
+	// a nonblocking file uses the runtime poller, Close stops a pending Read.
+	// w.file.Fd() must not be called, it would make the file blocking again.
+	w := &inotify{file: os.NewFile(uintptr(fd), "inotify"), root: dir, dirs: make(map[int]string)}
+	err = w.add(dir, outboxMask)
+	if err != nil {
+		w.file.Close()
+		return
+	}
+	aliases, err := ioutil.ReadDir(dir)
+	if err != nil {
+		w.file.Close()
+		return
+	}
+	for _, alias := range aliases {
+		if alias.IsDir() {
+			w.addAlias(filepath.Join(dir, alias.Name()))
+		}
+	}
+	ch := make(chan string)
+	go w.read(ctx, ch)
+	go func() {
+		<-ctx.Done()
+		w.file.Close()
+	}()
+	return ch, nil
+}
+
+// add watches dir, the descriptor is borrowed with Control so it stays
+// nonblocking and is not closed meanwhile.
+func (w *inotify) add(dir string, mask uint32) (err error) {
+	conn, err := w.file.SyscallConn()
+	if err != nil {
+		return
+	}
+	var wd int
+	errControl := conn.Control(func(fd uintptr) {
+		wd, err = unix.InotifyAddWatch(int(fd), dir, mask)
+	})
+	if errControl != nil {
+		return errControl
+	}
+	if err != nil {
+		return
+	}
+	w.dirs[wd] = dir
+	return nil
+}
+
+// addAlias watches an alias directory, files in it are found by scanning
+// the outbox if that fails.
+func (w *inotify) addAlias(dir string) {
+	err := w.add(dir, aliasMask)
+	if err != nil {
+		log.Printf("WARNING: could not watch '%s': %s\n", dir, err.Error())
+	}
+}
+
+// read sends the paths of files that are ready to ch
+func (w *inotify) read(ctx context.Context, ch chan<- string) {
+	defer close(ch)
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("ERROR watching outbox: %s\n", err.Error())
+			}
+			return
+		}
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			e := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + unix.SizeofInotifyEvent
+			offset = start + int(e.Len)
+			name := strings.TrimRight(string(buf[start:offset]), "\x00")
+			dir, ok := w.dirs[int(e.Wd)]
+			switch {
+			case e.Mask&unix.IN_IGNORED != 0:
+				delete(w.dirs, int(e.Wd))
+			case !ok || name == "":
+				// the queue overflowed, scanning finds what was missed
+			case dir == w.root:
+				if e.Mask&unix.IN_ISDIR != 0 {
+					w.addAlias(filepath.Join(dir, name))
+				}
+			case e.Mask&unix.IN_ISDIR == 0:
+				select {
+				case ch <- filepath.Join(dir, name):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}
+}
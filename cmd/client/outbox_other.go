@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"context"
+)
+
+// watchOutbox is only supported on Linux, elsewhere the outbox is scanned
+func watchOutbox(ctx context.Context, dir string) (ready <-chan string, err error) {
+	return nil, errNoWatch
+}
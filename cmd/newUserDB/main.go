@@ -3,33 +3,72 @@ package main
 import (
 	"flag"
 	"github.com/cathalgarvey/go-minilock"
+	"github.com/scusi/secureShare/libs/server/config"
 	"github.com/scusi/secureShare/libs/server/user"
 	"log"
+	"os"
 )
 
-var userDB *user.UserDB
+var userDB user.UserStore
 var err error
 var userName string
 var userPasswd string
+var usersFile string
+var userStore string
+var migrate string
 
 func init() {
 	flag.StringVar(&userName, "u", "", "username to be used")
 	flag.StringVar(&userPasswd, "p", "", "user password")
-	userDB = new(user.UserDB)
-	/*
-		userDB, err = user.LoadFromFile("users.yml")
-		if err != nil {
-			log.Println(err)
-			userDB = new(user.UserDB)
-		}
-	*/
-	userDB.Path = "users.yml"
+	flag.StringVar(&usersFile, "f", "users.yml", "user database file to create or add to")
+	flag.StringVar(&userStore, "store", "yaml", "format of the user database file: 'yaml' or 'bolt'")
+	flag.StringVar(&migrate, "migrate", "", "yaml user database to copy all users from, e.g. to a new bolt database")
 }
 
 func main() {
 	flag.Parse()
+	cfg := config.New()
+	cfg.UsersFile = usersFile
+	cfg.UserStore = userStore
+	if cfg.UserStore == "yaml" {
+		// an empty yaml user database has to be written first
+		udb := new(user.UserDB)
+		udb.Path = usersFile
+		_, err = user.LoadFromFile(usersFile)
+		if os.IsNotExist(err) {
+			err = udb.Save("")
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	userDB, err = user.Open(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer userDB.Close()
+
+	// copy the users of an existing yaml user database, it is only read
+	if migrate != "" {
+		from, err := user.ReadFromFile(migrate)
+		if err != nil {
+			log.Fatal(err)
+		}
+		users, err := from.List()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, u := range users {
+			err = userDB.Put(u)
+			if err != nil {
+				log.Fatalf("ERROR migrating user '%s': %s\n", u.Name, err.Error())
+			}
+		}
+		log.Printf("migrated %d users from '%s' to '%s' (%s)\n", len(users), migrate, usersFile, userStore)
+		return
+	}
+
 	if userName == "" || userPasswd == "" {
-		userDB.Save("")
 		return
 	}
 	// generate key
@@ -43,26 +82,10 @@ func main() {
 		panic(err)
 	}
 	log.Printf("EncodeID: %s\n", encodeID)
-	err = userDB.Add(userName, encodeID)
+	token, err := userDB.Add(userName, encodeID)
 	if err != nil {
 		log.Println(err.Error())
 	}
-	/*
-			log.Printf("userDB (%v):\n%#v\n", &userDB, userDB)
-			err = user.SaveToFile(*userDB, "users.yml")
-			if err != nil {
-				panic(err)
-			}
-			err = userDB.Save("users.yml")
-			if err != nil {
-				panic(err)
-			}
-
-		if userDB.Authenticate(userName, userPasswd) {
-			log.Printf("AUTHENTICATED!")
-			log.Printf("APIToken for %s: %s\n", userName, userDB.APIToken(userName))
-		}
-	*/
-	log.Printf("APIToken for %s: %s\n", userName, userDB.APIToken(userName))
+	log.Printf("APIToken for %s: %s\n", userName, token)
 
 }
@@ -0,0 +1,73 @@
+// accounts - users can delete their account
+package main
+
+import (
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// DeleteAccount removes the authenticated user from the user database and
+// purges all files waiting for the user as well as the users unfinished
+// upload sessions.
+func DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	username := r.Header.Get("Apiusername")
+	err := deleteUser(username)
+	if err != nil {
+		log.Printf("ERROR deleting user '%s': %s\n", username, err.Error())
+		http.Error(w, "could not delete account", 500)
+		return
+	}
+	log.Printf("account '%s' deleted\n", username)
+}
+
+// deleteUser removes a user from the user database along with the files
+// and upload sessions of the user.
+func deleteUser(username string) (err error) {
+	// no files can be delivered to the user from now on
+	err = userDB.Delete(username)
+	if err != nil {
+		return
+	}
+	events.closeRevoked(username)
+	purgeFiles(username)
+	purgeSessions(username)
+	return
+}
+
+// purgeFiles erases all files waiting for a user
+func purgeFiles(username string) (count int) {
+	keys, err := listFiles(username + "/")
+	if err != nil {
+		log.Printf("ERROR listing files of '%s': %s\n", username, err.Error())
+		return
+	}
+	for _, key := range keys {
+		err = eraseFile(key)
+		if err != nil {
+			log.Printf("ERROR erasing '%s': %s\n", key, err.Error())
+			continue
+		}
+		count++
+	}
+	return
+}
+
+// purgeSessions removes all upload sessions of a user
+func purgeSessions(username string) {
+	files, err := filepath.Glob(filepath.Join(cfg.DataDir, sessionDir, "*.yml"))
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		id := strings.TrimSuffix(filepath.Base(f), ".yml")
+		s, err := loadSession(id)
+		if err != nil || s.Owner != username {
+			continue
+		}
+		unlock := lockSession(id)
+		removeSession(id)
+		unlock()
+	}
+}
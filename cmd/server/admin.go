@@ -0,0 +1,370 @@
+// admin API - operators manage invites and accounts of a running server
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/scusi/secureShare/libs/server/user"
+	"log"
+	"net/http"
+	"time"
+)
+
+// AdminUserInfo describes an account for the admin, tokens are named only
+type AdminUserInfo struct {
+	Name     string   `json:"name"`
+	Pending  bool     `json:"pending"`
+	Disabled bool     `json:"disabled"`
+	Tokens   []string `json:"tokens"`
+}
+
+// AdminUserDetails describes a single account in detail
+type AdminUserDetails struct {
+	AdminUserInfo
+	PublicKey string      `json:"publicKey"`
+	TokenInfo []TokenInfo `json:"tokenInfo"`
+	Files     int         `json:"files"`
+	Bytes     int64       `json:"bytes"`
+}
+
+// AdminUsage shows the storage used by all users
+type AdminUsage struct {
+	Users       []AdminUserUsage `json:"users"`
+	Files       int              `json:"files"`
+	Bytes       int64            `json:"bytes"`       // size of all files, counted for every recipient
+	Blobs       int              `json:"blobs"`       // number of distinct stored contents
+	StoredBytes int64            `json:"storedBytes"` // size actually stored, every content counted once
+}
+
+// AdminUserUsage shows the storage used by the files waiting for a user
+type AdminUserUsage struct {
+	Name  string `json:"name"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+// AdminInvite is an invite code as sent by the admin API
+type AdminInvite struct {
+	Code    string     `json:"code"`
+	Note    string     `json:"note,omitempty"`
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// startAdmin serves the admin API on cfg.AdminListenAddr, if an AdminToken
+// is configured. The admin API has no TLS, keep it on a local address.
+func startAdmin() {
+	if cfg.AdminListenAddr == "" || cfg.AdminToken == "" {
+		log.Printf("admin API disabled, set adminlistenaddr and admintoken to enable it\n")
+		return
+	}
+	router := mux.NewRouter().StrictSlash(true)
+	router.HandleFunc("/invites", AdminAuthenticated(AdminListInvites)).Methods("GET")
+	router.HandleFunc("/invites", AdminAuthenticated(AdminCreateInvite)).Methods("POST")
+	router.HandleFunc("/invites/{Code}", AdminAuthenticated(AdminRevokeInvite)).Methods("DELETE")
+	router.HandleFunc("/users", AdminAuthenticated(AdminListUsers)).Methods("GET")
+	router.HandleFunc("/users/{Name}", AdminAuthenticated(AdminInspectUser)).Methods("GET")
+	router.HandleFunc("/users/{Name}", AdminAuthenticated(AdminDeleteUser)).Methods("DELETE")
+	router.HandleFunc("/users/{Name}/approve", AdminAuthenticated(AdminApproveUser)).Methods("POST")
+	router.HandleFunc("/users/{Name}/disable", AdminAuthenticated(AdminDisableUser)).Methods("POST")
+	router.HandleFunc("/users/{Name}/enable", AdminAuthenticated(AdminEnableUser)).Methods("POST")
+	router.HandleFunc("/users/{Name}/reset-token", AdminAuthenticated(AdminResetToken)).Methods("POST")
+	router.HandleFunc("/users/{Name}/files", AdminAuthenticated(AdminListFiles)).Methods("GET")
+	router.HandleFunc("/users/{Name}/files", AdminAuthenticated(AdminPurgeFiles)).Methods("DELETE")
+	router.HandleFunc("/usage", AdminAuthenticated(AdminStorageUsage)).Methods("GET")
+	router.HandleFunc("/verify", AdminAuthenticated(AdminVerify)).Methods("GET")
+	log.Printf("adminListenAddr: %s\n", cfg.AdminListenAddr)
+	go func() {
+		log.Fatal(http.ListenAndServe(cfg.AdminListenAddr, router))
+	}()
+}
+
+// AdminAuthenticated wraps a handler of the admin API, requests need the
+// configured AdminToken in the 'Admintoken' header. Failed attempts lock out
+// the client IP from the admin API, see adminLockoutKey.
+func AdminAuthenticated(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := adminLockoutKey(r)
+		if locked, retryAfter := lockedOut(key); locked {
+			tooManyRequests(w, retryAfter)
+			return
+		}
+		token := r.Header.Get("Admintoken")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) != 1 {
+			log.Printf("admin authentication failed on '%s' from %s\n", r.URL.Path, r.RemoteAddr)
+			authFailed(key)
+			w.Header().Set("WWW-Authenticate", "Admintoken")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// sendJSON sends v as the JSON response
+func sendJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("ERROR encoding response: %s\n", err.Error())
+	}
+}
+
+// adminInvite converts an invite for the admin API
+func adminInvite(i user.Invite) (a AdminInvite) {
+	a = AdminInvite{Code: i.Code, Note: i.Note, Created: i.Created}
+	if !i.Expires.IsZero() {
+		expires := i.Expires
+		a.Expires = &expires
+	}
+	return
+}
+
+// AdminListInvites sends the unused invites
+func AdminListInvites(w http.ResponseWriter, r *http.Request) {
+	list := []AdminInvite{}
+	for _, i := range invites.List() {
+		list = append(list, adminInvite(i))
+	}
+	sendJSON(w, list)
+}
+
+// AdminCreateInvite creates an invite with the note given in the form value
+// 'note'. It expires after the duration in the form value 'ttl', if given.
+func AdminCreateInvite(w http.ResponseWriter, r *http.Request) {
+	var ttl time.Duration
+	if v := r.FormValue("ttl"); v != "" {
+		var err error
+		ttl, err = time.ParseDuration(v)
+		if err != nil || ttl < 0 {
+			http.Error(w, "invalid ttl", 400)
+			return
+		}
+	}
+	i, err := invites.Create(r.FormValue("note"), ttl)
+	if err != nil {
+		log.Printf("ERROR creating invite: %s\n", err.Error())
+		http.Error(w, "could not create invite", 500)
+		return
+	}
+	log.Printf("invite created\n")
+	sendJSON(w, adminInvite(i))
+}
+
+// AdminRevokeInvite removes an unused invite
+func AdminRevokeInvite(w http.ResponseWriter, r *http.Request) {
+	err := invites.Revoke(mux.Vars(r)["Code"])
+	if err == user.ErrInvalidInvite {
+		http.Error(w, "invite not found", 404)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR revoking invite: %s\n", err.Error())
+		http.Error(w, "could not revoke invite", 500)
+		return
+	}
+	log.Printf("invite revoked\n")
+}
+
+// AdminListUsers sends all accounts, only pending ones with the form value
+// 'pending' set to 'true'.
+func AdminListUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := userDB.List()
+	if err != nil {
+		log.Printf("ERROR listing users: %s\n", err.Error())
+		http.Error(w, "could not list users", 500)
+		return
+	}
+	pendingOnly := r.FormValue("pending") == "true"
+	list := []AdminUserInfo{}
+	for _, u := range users {
+		if pendingOnly && !u.Pending {
+			continue
+		}
+		list = append(list, adminUserInfo(u))
+	}
+	sendJSON(w, list)
+}
+
+// adminUserInfo converts a user for the admin API
+func adminUserInfo(u user.User) (info AdminUserInfo) {
+	info = AdminUserInfo{Name: u.Name, Pending: u.Pending, Disabled: u.Disabled, Tokens: []string{}}
+	for _, t := range u.Tokens {
+		info.Tokens = append(info.Tokens, t.Name)
+	}
+	return
+}
+
+// adminUser returns the user named in the route, it sends a 404 if there
+// is no such user.
+func adminUser(w http.ResponseWriter, r *http.Request) (u *user.User, ok bool) {
+	u, err := userDB.Get(mux.Vars(r)["Name"])
+	if err == user.ErrNotFound {
+		http.Error(w, "user not found", 404)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("ERROR reading user: %s\n", err.Error())
+		http.Error(w, "could not read user", 500)
+		return nil, false
+	}
+	return u, true
+}
+
+// AdminInspectUser sends the details of an account, including the files
+// waiting for it.
+func AdminInspectUser(w http.ResponseWriter, r *http.Request) {
+	u, ok := adminUser(w, r)
+	if !ok {
+		return
+	}
+	details := AdminUserDetails{
+		AdminUserInfo: adminUserInfo(*u),
+		PublicKey:     u.PublicKey,
+		TokenInfo:     []TokenInfo{},
+	}
+	for _, t := range u.Tokens {
+		details.TokenInfo = append(details.TokenInfo, TokenInfo{Name: t.Name, Created: t.Created})
+	}
+	files, err := userFiles(u.Name)
+	if err != nil {
+		log.Printf("ERROR listing files of '%s': %s\n", u.Name, err.Error())
+		http.Error(w, "could not list files", 500)
+		return
+	}
+	for _, f := range files {
+		details.Files++
+		details.Bytes += f.Size
+	}
+	sendJSON(w, details)
+}
+
+// AdminDeleteUser deletes an account along with its files and sessions
+func AdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["Name"]
+	err := deleteUser(username)
+	if err == user.ErrNotFound {
+		http.Error(w, "user not found", 404)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR deleting user '%s': %s\n", username, err.Error())
+		http.Error(w, "could not delete user", 500)
+		return
+	}
+	log.Printf("account '%s' deleted by admin\n", username)
+}
+
+// AdminDisableUser locks a user out, all tokens of the user are refused
+// until the account is enabled again.
+func AdminDisableUser(w http.ResponseWriter, r *http.Request) {
+	setDisabled(w, r, true)
+}
+
+// AdminEnableUser lifts the lock of AdminDisableUser
+func AdminEnableUser(w http.ResponseWriter, r *http.Request) {
+	setDisabled(w, r, false)
+}
+
+func setDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	username := mux.Vars(r)["Name"]
+	err := userDB.Update(username, func(u *user.User) error {
+		u.Disabled = disabled
+		return nil
+	})
+	if err == user.ErrNotFound {
+		http.Error(w, "user not found", 404)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR changing user '%s': %s\n", username, err.Error())
+		http.Error(w, "could not change user", 500)
+		return
+	}
+	log.Printf("user '%s' disabled: %t\n", username, disabled)
+	events.closeRevoked(username)
+}
+
+// AdminResetToken replaces all tokens of a user with a new one. It is sent
+// to the admin encrypted to the user, the admin hands it on to the user.
+func AdminResetToken(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["Name"]
+	token, err := userDB.NewAPIToken(username)
+	if err == user.ErrNotFound {
+		http.Error(w, "user not found", 404)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR resetting token of '%s': %s\n", username, err.Error())
+		http.Error(w, "could not reset token", 500)
+		return
+	}
+	log.Printf("tokens of '%s' reset by admin\n", username)
+	events.closeRevoked(username)
+	sendUserToken(w, username, token)
+}
+
+// AdminListFiles sends the files waiting for a user
+func AdminListFiles(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["Name"]
+	files, err := userFiles(username)
+	if err != nil {
+		log.Printf("ERROR listing files of '%s': %s\n", username, err.Error())
+		http.Error(w, "could not list files", 500)
+		return
+	}
+	sendJSON(w, files)
+}
+
+// AdminPurgeFiles erases all files waiting for a user and sends how many
+// files were erased.
+func AdminPurgeFiles(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["Name"]
+	count := purgeFiles(username)
+	log.Printf("%d files of '%s' purged by admin\n", count, username)
+	fmt.Fprintf(w, "%d", count)
+}
+
+// AdminStorageUsage sends the storage used per user and in total
+func AdminStorageUsage(w http.ResponseWriter, r *http.Request) {
+	usage, err := storageUsage()
+	if err != nil {
+		log.Printf("ERROR computing storage usage: %s\n", err.Error())
+		http.Error(w, "could not compute storage usage", 500)
+		return
+	}
+	sendJSON(w, usage)
+}
+
+// AdminVerify checks the user database and the stored files against each
+// other and sends the problems found.
+func AdminVerify(w http.ResponseWriter, r *http.Request) {
+	report, err := verifyStores()
+	if err != nil {
+		log.Printf("ERROR verifying stores: %s\n", err.Error())
+		http.Error(w, "could not verify stores", 500)
+		return
+	}
+	sendJSON(w, report)
+}
+
+// AdminApproveUser activates an account that waits for approval
+func AdminApproveUser(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["Name"]
+	err := userDB.Update(username, func(u *user.User) error {
+		u.Pending = false
+		return nil
+	})
+	if err == user.ErrNotFound {
+		http.Error(w, "user not found", 404)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR approving user '%s': %s\n", username, err.Error())
+		http.Error(w, "could not approve user", 500)
+		return
+	}
+	log.Printf("user '%s' approved\n", username)
+}
@@ -0,0 +1,50 @@
+// authentication - checks the API credentials of every request
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+)
+
+// unauthorized sends the response for requests without valid credentials,
+// it is the same no matter what was wrong with them.
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", "Apikey")
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// Authenticated wraps a handler that may only be called with valid API
+// credentials in the 'Apiusername' and 'Apikey' headers. Handlers wrapped
+// can rely on the 'Apiusername' header to name the authenticated user.
+// Routes with a {UserID} variable are only served to that very user.
+// Client IPs failing to authenticate too often are locked out for a while,
+// see userLockoutKey.
+func Authenticated(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, counted := userLockoutKey(r)
+		if locked, retryAfter := lockedOut(key); counted && locked {
+			tooManyRequests(w, retryAfter)
+			return
+		}
+		username := r.Header.Get("Apiusername")
+		token := r.Header.Get("Apikey")
+		if username == "" || token == "" || !userDB.APIAuthenticate(username, token) {
+			if Debug {
+				log.Printf("authentication failed for '%s' on '%s'\n", username, r.URL.Path)
+			}
+			// requests without credentials are no guesses
+			if counted && username != "" && token != "" {
+				authFailed(key)
+			}
+			unauthorized(w)
+			return
+		}
+		if userID, ok := mux.Vars(r)["UserID"]; ok && userID != username {
+			log.Printf("user '%s' denied access to '%s'\n", username, r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
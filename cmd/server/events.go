@@ -0,0 +1,153 @@
+// events - users are told about changes of their inbox as they happen
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// event types
+const (
+	EventNewFile = "new"     // a file arrived for the user
+	EventExpired = "expired" // a file was removed because it expired
+)
+
+// eventBuffer is the number of events kept for a slow subscriber, further
+// events are dropped for it.
+const eventBuffer = 16
+
+// maxSubscriptions limits the open event streams of a user
+const maxSubscriptions = 10
+
+// keepaliveInterval is the interval comments are sent on idle streams, so
+// proxies do not close them.
+const keepaliveInterval = 30 * time.Second
+
+// Event tells a user about a change of the inbox
+type Event struct {
+	Type   string    `json:"type"`
+	FileID string    `json:"fileID"`
+	Size   int64     `json:"size,omitempty"`
+	Sender string    `json:"sender,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// broker hands events to the subscribers of a user
+type broker struct {
+	mu   sync.Mutex
+	subs map[string]map[chan Event]string // subscribers by username, with the token they subscribed with
+}
+
+var events = &broker{subs: make(map[string]map[chan Event]string)}
+
+// subscribe returns a channel receiving the events of username, ok is false
+// if the user has too many subscriptions. The channel is closed once token
+// is no longer valid, see closeRevoked.
+func (b *broker) subscribe(username, token string) (ch chan Event, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.subs[username]) >= maxSubscriptions {
+		return nil, false
+	}
+	if b.subs[username] == nil {
+		b.subs[username] = make(map[chan Event]string)
+	}
+	ch = make(chan Event, eventBuffer)
+	b.subs[username][ch] = token
+	return ch, true
+}
+
+func (b *broker) unsubscribe(username string, ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs[username], ch)
+	if len(b.subs[username]) == 0 {
+		delete(b.subs, username)
+	}
+}
+
+// closeRevoked ends the subscriptions of username made with a token that
+// is no longer valid, like after the token was revoked or the account was
+// deleted or disabled.
+func (b *broker) closeRevoked(username string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch, token := range b.subs[username] {
+		if userDB.APIAuthenticate(username, token) {
+			continue
+		}
+		close(ch)
+		delete(b.subs[username], ch)
+	}
+	if len(b.subs[username]) == 0 {
+		delete(b.subs, username)
+	}
+}
+
+// publish sends e to all subscribers of username without waiting for them
+func (b *broker) publish(username string, e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs[username] {
+		select {
+		case ch <- e:
+		default:
+			log.Printf("event for '%s' dropped, subscriber is too slow\n", username)
+		}
+	}
+}
+
+// Events streams the events of the authenticated user as Server-Sent
+// Events, until the client disconnects or its token is revoked.
+func Events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", 500)
+		return
+	}
+	username := r.Header.Get("Apiusername")
+	ch, ok := events.subscribe(username, r.Header.Get("Apikey"))
+	if !ok {
+		tooManyRequests(w, time.Minute)
+		return
+	}
+	defer events.unsubscribe(username, ch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, open := <-ch:
+			if !open {
+				return
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				log.Printf("ERROR encoding event: %s\n", err.Error())
+				continue
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+			if err != nil {
+				return
+			}
+		case <-keepalive.C:
+			_, err := fmt.Fprintf(w, ": keepalive\n\n")
+			if err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
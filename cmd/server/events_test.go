@@ -0,0 +1,104 @@
+package main
+
+import (
+	"github.com/cathalgarvey/go-minilock"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// addTestUser adds alice to the user database and returns her token
+func addTestUser(t *testing.T) (token string) {
+	keys, err := minilock.GenerateKey("test@example.org", "correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := keys.EncodeID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err = userDB.Add("alice", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// isClosed reports whether ch was closed by the broker
+func isClosed(ch chan Event) bool {
+	select {
+	case _, open := <-ch:
+		return !open
+	default:
+		return false
+	}
+}
+
+func TestCloseRevoked(t *testing.T) {
+	defer setupLockout(t)()
+	defer setupStore(t)()
+	token := addTestUser(t)
+	laptop, err := userDB.CreateToken("alice", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := events.subscribe("alice", token)
+	second, _ := events.subscribe("alice", laptop)
+	err = userDB.RevokeToken("alice", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events.closeRevoked("alice")
+	if isClosed(first) {
+		t.Error("subscription with a valid token closed")
+	}
+	if !isClosed(second) {
+		t.Error("subscription with a revoked token still open")
+	}
+	err = deleteUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isClosed(first) {
+		t.Error("subscription of a deleted user still open")
+	}
+	if n := len(events.subs["alice"]); n != 0 {
+		t.Errorf("%d subscriptions left for a deleted user", n)
+	}
+}
+
+func TestEventsEndOnRevoke(t *testing.T) {
+	defer setupLockout(t)()
+	token := addTestUser(t)
+	r := httptest.NewRequest("GET", "/events", nil)
+	r.Header.Set("Apiusername", "alice")
+	r.Header.Set("Apikey", token)
+	done := make(chan bool)
+	go func() {
+		Events(httptest.NewRecorder(), r)
+		close(done)
+	}()
+	// wait for the stream to subscribe
+	for i := 0; ; i++ {
+		events.mu.Lock()
+		n := len(events.subs["alice"])
+		events.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if i > 100 {
+			t.Fatal("stream did not subscribe")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err := userDB.NewAPIToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events.closeRevoked("alice")
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("stream still open after its token was reset")
+	}
+}
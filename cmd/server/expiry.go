@@ -0,0 +1,124 @@
+// file expiry - removes files nobody picked up in time
+package main
+
+import (
+	"fmt"
+	"github.com/scusi/secureShare/libs/server/storage"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// uploadTTL returns the time an uploaded file is kept, given the ttl the
+// sender asked for. An empty ttl selects the configured default, longer
+// ttls are capped by the configured maximum. With a maximum configured,
+// no file is kept forever.
+func uploadTTL(requested string) (ttl time.Duration, err error) {
+	ttl = cfg.DefaultTTL
+	if requested != "" {
+		ttl, err = time.ParseDuration(requested)
+		if err != nil {
+			return 0, fmt.Errorf("invalid ttl '%s'", requested)
+		}
+		if ttl <= 0 {
+			ttl = cfg.DefaultTTL
+		}
+	}
+	if cfg.MaxTTL > 0 && (ttl <= 0 || ttl > cfg.MaxTTL) {
+		ttl = cfg.MaxTTL
+	}
+	return
+}
+
+// sweep runs forever and removes expired files and abandoned upload
+// sessions every interval.
+func sweep(interval time.Duration) {
+	for {
+		sweepFiles()
+		sweepSessions()
+		time.Sleep(interval)
+	}
+}
+
+// expired reports whether a file with the given metadata expired at now
+func expired(meta *storage.Meta, now time.Time) bool {
+	return !meta.Expires.IsZero() && !meta.Expires.After(now)
+}
+
+func sweepFiles() {
+	now := time.Now()
+	keys, err := listFiles("")
+	if err != nil {
+		log.Printf("ERROR listing files: %s\n", err.Error())
+		return
+	}
+	for _, key := range keys {
+		meta, err := metaStore.Read(key)
+		if os.IsNotExist(err) {
+			startExpiry(key, now)
+			continue
+		}
+		if err != nil || !expired(meta, now) {
+			continue
+		}
+		err = eraseFile(key)
+		if err != nil {
+			log.Printf("ERROR erasing expired file '%s': %s\n", key, err.Error())
+			continue
+		}
+		log.Printf("expired file '%s' erased\n", key)
+		owner := fileOwner(key)
+		events.publish(owner, Event{Type: EventExpired, FileID: strings.TrimPrefix(key, owner+"/")})
+	}
+}
+
+// startExpiry gives a file stored without metadata, by an older server
+// version, the default ttl from now on. Its modification time is not used,
+// that would erase all old files with the first sweep.
+func startExpiry(key string, now time.Time) {
+	ttl, _ := uploadTTL("")
+	if ttl <= 0 {
+		return
+	}
+	meta, err := fileMeta(key)
+	if err != nil {
+		return
+	}
+	meta.Expires = now.Add(ttl)
+	err = metaStore.Write(key, meta)
+	if err != nil {
+		log.Printf("ERROR writing metadata of '%s': %s\n", key, err.Error())
+		return
+	}
+	log.Printf("file '%s' without metadata expires at %s\n", key, meta.Expires.Format(time.RFC3339))
+}
+
+// sweepSessions removes upload sessions that were not committed within the
+// time their file would have been kept.
+func sweepSessions() {
+	ttl := cfg.MaxTTL
+	if ttl == 0 {
+		ttl = cfg.DefaultTTL
+	}
+	if ttl == 0 {
+		return
+	}
+	dir := filepath.Join(cfg.DataDir, sessionDir)
+	files, err := filepath.Glob(filepath.Join(dir, "*.yml"))
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		id := strings.TrimSuffix(filepath.Base(f), ".yml")
+		s, err := loadSession(id)
+		if err != nil || time.Since(s.Created) < ttl {
+			continue
+		}
+		unlock := lockSession(id)
+		removeSession(id)
+		unlock()
+		log.Printf("abandoned upload session '%s' removed\n", id)
+	}
+}
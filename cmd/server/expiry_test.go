@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/scusi/secureShare/libs/server/config"
+	"testing"
+	"time"
+)
+
+func TestUploadTTL(t *testing.T) {
+	cfg = config.New()
+	for _, c := range []struct {
+		defaultTTL, maxTTL time.Duration
+		requested          string
+		want               time.Duration
+	}{
+		{72 * time.Hour, 168 * time.Hour, "", 72 * time.Hour},
+		{72 * time.Hour, 168 * time.Hour, "24h", 24 * time.Hour},
+		{72 * time.Hour, 168 * time.Hour, "1000h", 168 * time.Hour},
+		{72 * time.Hour, 168 * time.Hour, "0s", 72 * time.Hour},
+		{72 * time.Hour, 0, "1000h", 1000 * time.Hour},
+		{0, 0, "", 0},
+		// without a default, the maximum still applies
+		{0, 168 * time.Hour, "", 168 * time.Hour},
+		{0, 168 * time.Hour, "0s", 168 * time.Hour},
+		{0, 168 * time.Hour, "-1h", 168 * time.Hour},
+	} {
+		cfg.DefaultTTL = c.defaultTTL
+		cfg.MaxTTL = c.maxTTL
+		ttl, err := uploadTTL(c.requested)
+		if err != nil {
+			t.Errorf("uploadTTL(%q): %s", c.requested, err)
+			continue
+		}
+		if ttl != c.want {
+			t.Errorf("uploadTTL(%q) with default %s, max %s = %s, want %s", c.requested, c.defaultTTL, c.maxTTL, ttl, c.want)
+		}
+	}
+	if _, err := uploadTTL("forever"); err == nil {
+		t.Error("invalid ttl accepted")
+	}
+}
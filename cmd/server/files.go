@@ -0,0 +1,170 @@
+// stored files - what recipients get is a reference to a blob
+package main
+
+import (
+	"fmt"
+	"github.com/scusi/secureShare/libs/server/common"
+	"github.com/scusi/secureShare/libs/server/storage"
+	"log"
+	"os"
+	"strings"
+)
+
+// fileKey returns the key the file with fileID is stored under for a user
+func fileKey(userName, fileID string) string {
+	return strings.Join([]string{userName, fileID}, "/")
+}
+
+// newFileID returns a random fileID that is not in use for any of the given
+// users. Collisions are unlikely, but checked for anyway, so no upload ever
+// replaces another one.
+func newFileID(userNames []string) (fileID string, err error) {
+	for attempt := 0; attempt < maxFileIDAttempts; attempt++ {
+		fileID, err = common.NewFileID()
+		if err != nil {
+			return
+		}
+		inUse := false
+		for _, userName := range userNames {
+			_, err = fileMeta(fileKey(userName, fileID))
+			if err == nil {
+				inUse = true
+				break
+			}
+			if !os.IsNotExist(err) {
+				return "", err
+			}
+		}
+		if !inUse {
+			return fileID, nil
+		}
+		log.Printf("fileID '%s' is in use already, trying another one\n", fileID)
+	}
+	return "", fmt.Errorf("no unused fileID found in %d attempts", maxFileIDAttempts)
+}
+
+// listFiles returns the keys of all stored files starting with prefix,
+// like "username/" for the files of a single user.
+func listFiles(prefix string) (keys []string, err error) {
+	all, err := store.List(prefix)
+	if err != nil {
+		return
+	}
+	seen := make(map[string]bool)
+	for _, k := range all {
+		// blobs and the server's own directories start with a dot
+		if strings.HasPrefix(k, ".") {
+			continue
+		}
+		// files stored by older server versions have no metadata record
+		if storage.IsMetaKey(k) {
+			k = storage.FileKey(k)
+		}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		keys = append(keys, k)
+	}
+	return
+}
+
+// userFiles describes all files waiting for a user
+func userFiles(username string) (files []FileInfo, err error) {
+	files = []FileInfo{}
+	keys, err := listFiles(username + "/")
+	if err != nil {
+		return
+	}
+	for _, k := range keys {
+		meta, err := fileMeta(k)
+		if err != nil {
+			log.Printf("ERROR: Could not list files for '%s': %s\n", username, err.Error())
+			continue
+		}
+		fi := FileInfo{
+			FileID:     strings.TrimPrefix(k, username+"/"),
+			Size:       meta.Size,
+			UploadedAt: meta.Uploaded,
+			Sender:     meta.Sender,
+		}
+		if !meta.Expires.IsZero() {
+			fi.ExpiresAt = &meta.Expires
+		}
+		files = append(files, fi)
+	}
+	return files, nil
+}
+
+// fileMeta returns the metadata of the file stored under key. For files
+// stored without metadata, by older server versions, it is derived from the
+// file itself. Such files do not expire until the sweep gave them an expiry
+// time, see sweepFiles.
+func fileMeta(key string) (meta *storage.Meta, err error) {
+	meta, err = metaStore.Read(key)
+	if err == nil {
+		return
+	}
+	info, err := store.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+	meta = &storage.Meta{Uploaded: info.ModTime, Size: info.Size}
+	return meta, nil
+}
+
+// openFile opens the content of the file stored under key
+func openFile(key string) (o storage.Object, info *storage.Info, err error) {
+	meta, err := metaStore.Read(key)
+	if err == nil && meta.Blob {
+		return blobs.Open(meta.Hash)
+	}
+	// files stored by older server versions keep their content themselves
+	info, err = store.Stat(key)
+	if err != nil {
+		return
+	}
+	o, err = store.Get(key)
+	return
+}
+
+// eraseFile removes the file stored under key along with its metadata.
+// Its blob is removed with the last reference to it. The metadata is
+// claimed first, so a reference is released exactly once, even if the same
+// file is erased concurrently.
+func eraseFile(key string) (err error) {
+	claimed := true
+	meta, err := metaStore.Claim(key)
+	if os.IsNotExist(err) {
+		// files stored by older server versions have no metadata
+		claimed = false
+		meta, err = fileMeta(key)
+		if os.IsNotExist(err) {
+			return nil
+		}
+	}
+	if err != nil {
+		return
+	}
+	if meta.Blob {
+		err = blobs.Release(meta.Hash)
+	} else {
+		// files stored by older server versions keep their content themselves
+		err = store.Delete(key)
+		if os.IsNotExist(err) {
+			// erased concurrently
+			return nil
+		}
+	}
+	if err != nil {
+		if claimed {
+			// give the claim back, so the file can be erased again later
+			if werr := metaStore.Write(key, meta); werr != nil {
+				log.Printf("ERROR restoring metadata of '%s': %s\n", key, werr.Error())
+			}
+		}
+		return
+	}
+	removedFromInbox(fileOwner(key), meta.Size)
+	return
+}
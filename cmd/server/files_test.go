@@ -0,0 +1,107 @@
+package main
+
+import (
+	"github.com/scusi/secureShare/libs/server/storage"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setupStore points the server at an empty filesystem store
+func setupStore(t *testing.T) (cleanup func()) {
+	dir, err := ioutil.TempDir("", "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = storage.NewFilesystem(dir)
+	metaStore = storage.NewMetaStore(store)
+	blobs = storage.NewBlobs(store)
+	inboxes.usage = make(map[string]*inbox)
+	sent.loaded = false
+	return func() { os.RemoveAll(dir) }
+}
+
+// storeShared stores content as a single blob referenced by every user
+func storeShared(t *testing.T, fileID, content string, userNames ...string) (meta *storage.Meta) {
+	tmp, err := ioutil.TempFile("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	tmp.WriteString(content)
+	tmp.Close()
+	meta = &storage.Meta{
+		Uploaded:   time.Now(),
+		Size:       int64(len(content)),
+		Hash:       "hash-" + fileID,
+		Recipients: len(userNames),
+		Blob:       true,
+	}
+	err = blobs.Add(tmp.Name(), meta.Hash, len(userNames))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, userName := range userNames {
+		err = metaStore.Write(fileKey(userName, fileID), meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return
+}
+
+func TestConcurrentEraseReleasesOnce(t *testing.T) {
+	defer setupStore(t)()
+	meta := storeShared(t, "f1", "shared content", "alice", "bob")
+	// alice acknowledges the file many times at once
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			eraseFile(fileKey("alice", "f1"))
+		}()
+	}
+	wg.Wait()
+	if !blobs.Has(meta.Hash) {
+		t.Fatal("blob removed while bob still holds a reference")
+	}
+	if refs, _ := blobs.Refs(meta.Hash); refs != 1 {
+		t.Errorf("%d references left, want 1", refs)
+	}
+	if _, err := metaStore.Read(fileKey("bob", "f1")); err != nil {
+		t.Errorf("bob lost his file: %s", err)
+	}
+	err := eraseFile(fileKey("bob", "f1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blobs.Has(meta.Hash) {
+		t.Error("blob kept after the last reference was released")
+	}
+}
+
+func TestEraseFileWithoutMeta(t *testing.T) {
+	defer setupStore(t)()
+	// files stored by older server versions have no metadata
+	tmp := filepath.Join(os.TempDir(), "legacy-upload")
+	err := ioutil.WriteFile(tmp, []byte("legacy"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp)
+	err = storage.StoreFile(store, tmp, fileKey("alice", "old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = eraseFile(fileKey("alice", "old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Stat(fileKey("alice", "old")); !os.IsNotExist(err) {
+		t.Errorf("legacy file not erased: %v", err)
+	}
+}
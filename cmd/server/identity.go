@@ -0,0 +1,103 @@
+// server identity - the minilock keys of the server
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/cathalgarvey/go-minilock"
+	"github.com/cathalgarvey/go-minilock/taber"
+	"github.com/scusi/secureShare/libs/server/common"
+	"log"
+	"net/http"
+)
+
+// serverKeys are the minilock keys of the server, nil if the config has no
+// Email and Password for them.
+var serverKeys *taber.Keys
+
+// serverID is the minilock ID (encodeID) of serverKeys
+var serverID string
+
+// signingKey is an ed25519 key derived from serverKeys, the server signs
+// answers with it that clients need to trust, like key lookups.
+var signingKey ed25519.PrivateKey
+
+// ServerIdentity is published at IdentityPath, so clients can learn and pin
+// the keys of the server.
+type ServerIdentity struct {
+	MinilockID  string `json:"minilockID"`
+	SigningKey  []byte `json:"signingKey"`  // ed25519 public key
+	Fingerprint string `json:"fingerprint"` // common.Fingerprint of MinilockID and SigningKey
+}
+
+// IdentityPath is the path the ServerIdentity is published at
+const IdentityPath = "/.well-known/secureshare"
+
+// challengeKeys encrypt registration challenges. These are the serverKeys,
+// or random keys if the server has no identity.
+var challengeKeys *taber.Keys
+
+// loadServerKeys derives the minilock keys of the server from the Email and
+// Password in the config.
+func loadServerKeys() (err error) {
+	if cfg.Email == "" || cfg.Password == "" {
+		log.Printf("WARNING: no server identity configured (email, password), API tokens are sent unencrypted\n")
+		challengeKeys, err = randomKeys()
+		return
+	}
+	keys, err := minilock.GenerateKey(cfg.Email, cfg.Password)
+	if err != nil {
+		return
+	}
+	id, err := keys.EncodeID()
+	if err != nil {
+		return
+	}
+	serverKeys, serverID = keys, id
+	challengeKeys = keys
+	// the signing key is bound to the minilock keys, but not the same key
+	seed := common.NewLongIDHash()
+	seed.Write([]byte("secureShare signing key"))
+	seed.Write(keys.Private)
+	signingKey = ed25519.NewKeyFromSeed(seed.Sum(nil))
+	log.Printf("server minilock ID: %s\n", serverID)
+	log.Printf("server fingerprint: %s\n", common.Fingerprint(serverID, signingKey.Public().(ed25519.PublicKey)))
+	return
+}
+
+// Identity publishes the ServerIdentity as JSON
+func Identity(w http.ResponseWriter, r *http.Request) {
+	if serverKeys == nil {
+		http.Error(w, "server has no identity", 404)
+		return
+	}
+	publicKey := signingKey.Public().(ed25519.PublicKey)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ServerIdentity{
+		MinilockID:  serverID,
+		SigningKey:  publicKey,
+		Fingerprint: common.Fingerprint(serverID, publicKey),
+	})
+}
+
+// sign sets the 'Signature' header of a response to the base64 encoded
+// ed25519 signature of message, if the server has an identity.
+func sign(w http.ResponseWriter, message []byte) {
+	if signingKey == nil {
+		return
+	}
+	w.Header().Set("Signature", base64.StdEncoding.EncodeToString(ed25519.Sign(signingKey, message)))
+}
+
+// randomKeys returns minilock keys derived from random credentials
+func randomKeys() (keys *taber.Keys, err error) {
+	secret := make([]byte, 32)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return
+	}
+	return minilock.GenerateKey("secureShareServer", fmt.Sprintf("%x", secret))
+}
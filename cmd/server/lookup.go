@@ -0,0 +1,27 @@
+// key lookup - users learn the public keys of their contacts
+package main
+
+import (
+	"fmt"
+	"github.com/scusi/secureShare/libs/server/common"
+	"net/http"
+)
+
+// LookupKey sends the public key of a user to an authenticated user, who
+// has to know the (salted hash) username already. The answer is signed by
+// the server, see sign. Lookups are limited by the rate limit of the
+// "lookup" route.
+func LookupKey(w http.ResponseWriter, r *http.Request) {
+	username := r.FormValue("username")
+	if username == "" {
+		http.Error(w, "'username' not supplied", 400)
+		return
+	}
+	publicKey := userDB.PublicKey(username)
+	if publicKey == "" {
+		http.Error(w, "user not found", 404)
+		return
+	}
+	sign(w, common.KeyLookupMessage(username, publicKey))
+	fmt.Fprintf(w, "%s", publicKey)
+}
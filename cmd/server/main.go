@@ -1,30 +1,40 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/gorilla/mux"
-	"github.com/peterbourgon/diskv"
 	"github.com/scusi/secureShare/libs/server/common"
 	"github.com/scusi/secureShare/libs/server/config"
+	"github.com/scusi/secureShare/libs/server/storage"
 	"github.com/scusi/secureShare/libs/server/user"
+	"hash"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
-var userDB *user.UserDB
+// incomingDir is the directory below DataDir where uploads are written to
+// before they are handed out to their recipients.
+const incomingDir = ".incoming"
+
+var userDB user.UserStore
 
 var Debug bool
 var configFile string
 var listenAddr string
-var store *diskv.Diskv
+var store storage.Storage
+var metaStore *storage.MetaStore
+var blobs *storage.Blobs
 var cfg *config.Config
 var err error
 
@@ -34,29 +44,6 @@ func init() {
 	flag.StringVar(&listenAddr, "l", "", "address to listen on, overwrites config value if set")
 }
 
-func AdvancedTransformExample(key string) *diskv.PathKey {
-	//log.Printf("Atransform: key: %s\n", key)
-	path := strings.Split(key, "/")
-	last := len(path) - 1
-	//log.Printf("path: '%s', last: '%d\n", path, last)
-	return &diskv.PathKey{
-		Path:     path[:last],
-		FileName: path[last],
-	}
-
-}
-
-// If you provide an AdvancedTransform, you must also provide its
-// inverse:
-
-func InverseTransformExample(pathKey *diskv.PathKey) (key string) {
-	//log.Printf("revTransform: pathKey: %+v\n", pathKey)
-	key = strings.Join(pathKey.Path, "/") + "/" + pathKey.FileName
-	//log.Printf("revTransform: key: %s\n", key)
-	return key
-
-}
-
 func main() {
 	flag.Parse()
 	// read and parse config
@@ -68,24 +55,61 @@ func main() {
 	if listenAddr != "" {
 		cfg.ListenAddr = listenAddr
 	}
-	userDB, err = user.LoadFromFile(cfg.UsersFile)
+	userDB, err = user.Open(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = loadServerKeys()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = checkRegistrationMode()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = setupRateLimits()
 	if err != nil {
 		log.Fatal(err)
 	}
 	// init file storage
-	store = diskv.New(diskv.Options{
-		BasePath:          cfg.DataDir,
-		AdvancedTransform: AdvancedTransformExample,
-		InverseTransform:  InverseTransformExample,
-	})
+	storage.Debug = Debug
+	store, err = storage.New(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	metaStore = storage.NewMetaStore(store)
+	blobs = storage.NewBlobs(store)
+	err = countInboxes()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// remove expired files in the background
+	if cfg.SweepInterval > 0 {
+		go sweep(cfg.SweepInterval)
+	}
 	// initialize http router
 	router := mux.NewRouter().StrictSlash(true)
-	router.HandleFunc("/{UserID}/{FileID}", Download)
-	router.HandleFunc("/upload/", Upload)
-	router.HandleFunc("/list/", List)
-	router.HandleFunc("/register/", Register)
-	router.HandleFunc("/lookupKey", LookupKey)
+	router.HandleFunc(IdentityPath, Limited("api", Identity)).Methods("GET")
+	router.HandleFunc("/upload/session", Protected("session", CreateSession)).Methods("POST")
+	router.HandleFunc("/upload/session/{SessionID}", Protected("session", SessionOffset)).Methods("GET")
+	router.HandleFunc("/upload/session/{SessionID}/commit", Protected("session", CommitSession)).Methods("POST")
+	router.HandleFunc("/upload/session/{SessionID}/{Offset}", Protected("session", PutChunk)).Methods("PUT")
+	router.HandleFunc("/token/list", Protected("api", ListTokens)).Methods("GET")
+	router.HandleFunc("/token/create", Protected("api", CreateToken)).Methods("POST")
+	router.HandleFunc("/token/rotate", Protected("api", RotateToken)).Methods("POST")
+	router.HandleFunc("/token/revoke", Protected("api", RevokeToken)).Methods("POST")
+	router.HandleFunc("/{UserID}/{FileID}", Protected("download", Download)).Methods("GET", "HEAD")
+	router.HandleFunc("/{UserID}/{FileID}", Protected("download", Acknowledge)).Methods("DELETE")
+	router.HandleFunc("/upload/", Protected("upload", Upload))
+	router.HandleFunc("/list/", Protected("api", List))
+	router.HandleFunc("/usage", Protected("api", GetUsage)).Methods("GET")
+	router.HandleFunc("/events", Protected("api", Events)).Methods("GET")
+	router.HandleFunc("/account", Protected("api", DeleteAccount)).Methods("DELETE")
+	router.HandleFunc("/register/confirm", Limited("register", ConfirmRegistration)).Methods("POST")
+	router.HandleFunc("/register/", Limited("register", Register))
+	router.HandleFunc("/lookupKey", Protected("lookup", LookupKey))
 	router.HandleFunc("/", Index)
+	startAdmin()
 	// start server
 	if cfg.CertFile != "" && cfg.KeyFile != "" {
 		log.Printf("listenAddr: %s (TLS)\n", cfg.ListenAddr)
@@ -100,82 +124,50 @@ func Index(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "https://github.com/scusi/secureShare", 301)
 }
 
-func Register(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Register -->")
-	username := r.FormValue("username")
-	pubID := r.FormValue("pubID")
-	if Debug {
-		log.Printf("username: '%s', pubID: '%s'", username, pubID)
-	}
-	// TODO: check if pubID is a syntactical valid minilock ID
+// ListContentType is the media type of the JSON file list, clients asking
+// for it (or any JSON) in the Accept header get a FileList instead of text.
+const ListContentType = "application/vnd.secureshare.list.v1+json"
 
-	if userDB.Lookup(username) {
-		http.Error(w, "User already existing", 500)
-		return
-	}
-	log.Printf("going to add new user '%s' with pubID '%s'\n", username, pubID)
-	err := userDB.Add(username, pubID)
-	if err != nil {
-		http.Error(w, "adding user failed", 500)
-		return
-	}
-	token := userDB.APIToken(username)
-	// TODO: encrypt token with client key
-	fmt.Fprintf(w, "%s", token)
-	return
+// FileList is the JSON response of List
+type FileList struct {
+	Version int        `json:"version"`
+	Files   []FileInfo `json:"files"`
 }
 
-func LookupKey(w http.ResponseWriter, r *http.Request) {
-	username := r.FormValue("username")
-	if username == "" {
-		http.Error(w, "'username' not supplied", 400)
-	}
-	publicKey := userDB.PublicKey(username)
-	fmt.Fprintf(w, "%s", publicKey)
+// FileInfo describes a file waiting for the user
+type FileInfo struct {
+	FileID     string     `json:"fileID"`
+	Size       int64      `json:"size"`
+	UploadedAt time.Time  `json:"uploadedAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	Sender     string     `json:"sender,omitempty"`
 }
 
 func List(w http.ResponseWriter, r *http.Request) {
 	username := r.Header.Get("Apiusername")
-	token := r.Header.Get("Apikey")
-	if userDB.APIAuthenticate(username, token) != true {
-		http.Error(w, "Unauthorized", 401)
+	files, err := userFiles(username)
+	if err != nil {
+		http.Error(w, "could not list files", 500)
+		log.Printf("ERROR: Could not list files for '%s': %s\n", username, err.Error())
 		return
 	}
-	keyChan := store.KeysPrefix(username, nil)
-	for k := range keyChan {
-		//TODO: get the file time and display it
-		fi, err := getFileInfo(k)
+	list := FileList{Version: 1, Files: files}
+	if strings.Contains(r.Header.Get("Accept"), "json") {
+		w.Header().Set("Content-Type", ListContentType)
+		err := json.NewEncoder(w).Encode(list)
 		if err != nil {
-			http.Error(w, "could not list files", 500)
-			log.Printf("ERROR: Could not list files for '%s': %s\n", username, err.Error())
+			log.Printf("ERROR: Could not send file list to '%s': %s\n", username, err.Error())
 		}
-		k = strings.TrimPrefix(k, username+"/")
-		fmt.Fprintf(w, "'%s'  %s\n", k, fi)
-	}
-}
-
-func getFileInfo(filename string) (fileInfo string, err error) {
-	// build filepath
-	filePath := filepath.Join(cfg.DataDir, filename)
-	// get size and creation date
-	f, err := os.Open(filePath)
-	if err != nil {
 		return
 	}
-	fi, err := f.Stat()
-	if err != nil {
-		return
-	}
-	// return size and creation date as string
-	size := fi.Size()
-	if err != nil {
-		return
-	}
-	modTime := fi.ModTime()
-	if err != nil {
-		return
+	// plain text for older clients
+	for _, fi := range list.Files {
+		expires := "never"
+		if fi.ExpiresAt != nil {
+			expires = fi.ExpiresAt.String()
+		}
+		fmt.Fprintf(w, "'%s'  %d, %s, %s\n", fi.FileID, fi.Size, fi.UploadedAt, expires)
 	}
-	return fmt.Sprintf("%d, %s", size, modTime), nil
 }
 
 func Upload(w http.ResponseWriter, r *http.Request) {
@@ -190,11 +182,6 @@ func Upload(w http.ResponseWriter, r *http.Request) {
 				log.Printf("Request:\n%s\n", dump)
 			}
 		}
-		// TODO: authenticate user
-
-		var inBuf bytes.Buffer
-		inWrt := bufio.NewWriter(&inBuf)
-		//var o object.Object
 		// extract file from request
 		//get the multipart reader for the request.
 		reader, err := r.MultipartReader()
@@ -205,66 +192,85 @@ func Upload(w http.ResponseWriter, r *http.Request) {
 
 		//copy each part to destination.
 		var recList bytes.Buffer
-		recListWriter := bufio.NewWriter(&recList)
+		var ttlValue bytes.Buffer
 		for {
 			part, err := reader.NextPart()
 			if err == io.EOF {
 				break
 			}
+			if err != nil {
+				log.Printf("ERROR reading multipart body: %s\n", err.Error())
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 			if part.FormName() == "recipientList" {
 				//log.Printf("recipientList from part: %+v", part)
-				_, err := io.Copy(recListWriter, part)
+				_, err := io.Copy(&recList, io.LimitReader(part, maxFormValueSize))
 				if err != nil {
 					log.Printf("ERROR: io.Copy recipientList: %s\n", err.Error())
 					return
 				}
 				//log.Printf("Copied %d byte from recList\n", n)
 			}
+			if part.FormName() == "ttl" {
+				_, err := io.Copy(&ttlValue, io.LimitReader(part, 64))
+				if err != nil {
+					log.Printf("ERROR: io.Copy ttl: %s\n", err.Error())
+					return
+				}
+			}
 			//if part.FileName() is empty, skip this iteration.
 			if part.FileName() == "" {
 				continue
 			}
 			//log.Printf("part.FileName = '%s'\n", part.FileName())
-			//n := int64(0)
-			if _, err = io.Copy(inWrt, part); err != nil {
-				log.Printf("Error copy file part: %s\n", err.Error())
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+			ttl, err := uploadTTL(strings.TrimSpace(ttlValue.String()))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// stream the file part to disk, the metadata is computed on the
+			// way. Files beyond the limits of sender and recipients are cut
+			// off right away.
+			sender := r.Header.Get("Apiusername")
+			recipientList := parseRecipientList(recList.String())
+			if userNames, unknown := existingUsers(recipientList); len(userNames) == 0 {
+				http.Error(w, unknown.Error(), http.StatusBadRequest)
+				return
+			}
+			limit, exceeded := uploadLimit(sender, recipientList)
+			tmpPath, meta, err := receiveFile(part, limit)
+			if err == errLimitExceeded {
+				log.Printf("upload of '%s' refused: %s\n", sender, exceeded.Error())
+				exceeded.send(w)
 				return
 			}
-			//log.Printf("copied %d byte to mime part\n", n)
-			// genFileID
-			fileID, err := common.ShortID(inBuf.Bytes())
 			if err != nil {
-				log.Printf("ERROR generating checksum blake2s: %s\n", err.Error())
-				//http.Error(w, err.Error(), 500)
-				fileID = common.LongID(inBuf.Bytes())
+				log.Printf("Error copy file part: %s\n", err.Error())
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
+			defer os.Remove(tmpPath)
 
 			// store file
 			//log.Printf("recList: %s\n", string(recList.Bytes()))
-			recipientList := strings.Split(string(recList.Bytes()), "\n")
-			for i, r := range recipientList {
-				if r == "" {
-					recipientList = append(recipientList[:i], recipientList[i+1:]...)
-				}
+			meta.Sender = sender
+			fileID, err := deliverFile(tmpPath, meta, recipientList, ttl)
+			if qe, ok := err.(*quotaError); ok {
+				log.Printf("upload of '%s' refused: %s\n", sender, qe.Error())
+				qe.send(w)
+				return
 			}
-			//log.Printf("recipientList: %q\n", recipientList)
-			for _, userName := range recipientList {
-				//name := userDB.LookupNameByPubkey(userID)
-				isExistent := userDB.Lookup(userName)
-				if isExistent == false {
-					log.Printf("ERROR: No user found with username: '%s'\n", userName)
-					continue
-				}
-				filePath := filepath.Join(userName, fileID)
-				//log.Printf("filePath: %s\n", filePath)
-				err = store.Write(filePath, inBuf.Bytes())
-				if err != nil {
-					log.Println(err)
-				}
-				log.Printf("file '%s' saved under: '%s'", fileID, filePath)
+			if unknown, ok := err.(unknownRecipientsError); ok {
+				http.Error(w, unknown.Error(), http.StatusBadRequest)
+				return
 			}
-			fmt.Fprintf(w, fileID)
+			if err != nil {
+				log.Printf("ERROR storing file: %s\n", err.Error())
+				http.Error(w, "could not store file", http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(w, "%s", fileID)
 		}
 	default:
 		http.Error(w, "Method not allowed", 405)
@@ -272,35 +278,215 @@ func Upload(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func Download(w http.ResponseWriter, r *http.Request) {
-	username := r.Header.Get("Apiusername")
-	token := r.Header.Get("Apikey")
-	if userDB.APIAuthenticate(username, token) != true {
-		http.Error(w, "Unauthorized", 401)
+// errLimitExceeded is returned by receiveFile for data beyond the limit
+var errLimitExceeded = fmt.Errorf("file exceeds the upload limit")
+
+// receiveFile streams r into a temporary file within the incoming directory
+// of the data dir. It returns the path of the temporary file together with
+// the metadata computed while the data was written. If r holds more than
+// limit byte errLimitExceeded is returned, a negative limit means no limit.
+func receiveFile(r io.Reader, limit int64) (tmpPath string, meta *storage.Meta, err error) {
+	tmpDir := filepath.Join(cfg.DataDir, incomingDir)
+	err = os.MkdirAll(tmpDir, 0700)
+	if err != nil {
+		return
+	}
+	f, err := ioutil.TempFile(tmpDir, "upload-")
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	h := newFileHasher()
+	if limit >= 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err == nil && limit >= 0 && n > limit {
+		err = errLimitExceeded
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		os.Remove(f.Name())
 		return
 	}
+	return f.Name(), h.Meta(), nil
+}
+
+// fileHasher computes the metadata of a file from the data written to it
+type fileHasher struct {
+	content hash.Hash // common.LongID
+	size    int64
+}
+
+func newFileHasher() (h *fileHasher) {
+	return &fileHasher{content: common.NewLongIDHash()}
+}
+
+func (h *fileHasher) Write(p []byte) (n int, err error) {
+	h.content.Write(p)
+	h.size += int64(len(p))
+	return len(p), nil
+}
+
+// Meta returns the metadata of the data written so far
+func (h *fileHasher) Meta() *storage.Meta {
+	return &storage.Meta{
+		Uploaded: time.Now(),
+		Size:     h.size,
+		Hash:     fmt.Sprintf("%x", h.content.Sum(nil)),
+	}
+}
+
+// parseRecipientList returns the usernames from a newline separated
+// recipientList, skipping empty lines.
+func parseRecipientList(recList string) (recipientList []string) {
+	for _, r := range strings.Split(recList, "\n") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		recipientList = append(recipientList, r)
+	}
+	return
+}
+
+// unknownRecipientsError refuses an upload none of the recipients of exist,
+// it names them.
+type unknownRecipientsError []string
+
+func (e unknownRecipientsError) Error() string {
+	return fmt.Sprintf("no user found with username: '%s'", strings.Join(e, "', '"))
+}
+
+// existingUsers splits recipientList into the users that exist and those
+// that do not.
+func existingUsers(recipientList []string) (userNames []string, unknown unknownRecipientsError) {
+	for _, userName := range recipientList {
+		if !userDB.Lookup(userName) {
+			log.Printf("ERROR: No user found with username: '%s'\n", userName)
+			unknown = append(unknown, userName)
+			continue
+		}
+		userNames = append(userNames, userName)
+	}
+	return
+}
+
+// maxFileIDAttempts is the number of random fileIDs tried before an upload
+// is given up.
+const maxFileIDAttempts = 8
+
+// fileIDs serializes choosing a fileID and claiming it for all recipients
+var fileIDs sync.Mutex
+
+// deliverFile stores the file at tmpPath for every existing user in
+// recipientList, to be kept for the given ttl. The content is stored once,
+// every recipient gets a reference to it. It returns the new fileID, which
+// is not in use for any of the recipients. Files exceeding a limit of the
+// sender or a recipient are refused with a *quotaError.
+func deliverFile(tmpPath string, meta *storage.Meta, recipientList []string, ttl time.Duration) (fileID string, err error) {
+	//log.Printf("recipientList: %q\n", recipientList)
+	userNames, unknown := existingUsers(recipientList)
+	if len(userNames) == 0 {
+		return "", unknown
+	}
+	meta.Recipients = len(userNames)
+	meta.Blob = true
+	if ttl > 0 {
+		meta.Expires = meta.Uploaded.Add(ttl)
+	}
+	err = blobs.Add(tmpPath, meta.Hash, len(userNames))
+	if err != nil {
+		return
+	}
+	release := func() {
+		for range userNames {
+			blobs.Release(meta.Hash)
+		}
+	}
+	err = reserveQuota(meta.Sender, userNames, meta.Size)
+	if err != nil {
+		release()
+		return
+	}
+	fileIDs.Lock()
+	defer fileIDs.Unlock()
+	fileID, err = newFileID(userNames)
+	if err != nil {
+		releaseQuota(meta.Sender, userNames, meta.Size)
+		release()
+		return
+	}
+	for _, userName := range userNames {
+		filePath := fileKey(userName, fileID)
+		//log.Printf("filePath: %s\n", filePath)
+		err := metaStore.Write(filePath, meta)
+		if err != nil {
+			log.Println(err)
+			removedFromInbox(userName, meta.Size)
+			continue
+		}
+		log.Printf("file '%s' saved under: '%s'", fileID, filePath)
+		events.publish(userName, Event{Type: EventNewFile, FileID: fileID, Size: meta.Size, Sender: meta.Sender})
+	}
+	return fileID, nil
+}
+
+// Download sends a file to its recipient. Range and If-Range requests are
+// supported, so interrupted downloads can be resumed. The file is kept
+// until the recipient acknowledges it, see Acknowledge.
+func Download(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userID := vars["UserID"]
 	fileID := vars["FileID"]
-	filePath := strings.Join([]string{userID, fileID}, "/")
-	data, err := store.Read(filePath)
+	filePath := fileKey(userID, fileID)
+	// the sweep may not have erased it yet
+	if meta, err := fileMeta(filePath); err == nil && expired(meta, time.Now()) {
+		http.Error(w, "file expired", http.StatusGone)
+		return
+	}
+	f, info, err := openFile(filePath)
 	if err != nil {
 		log.Printf("ERROR downloading '%s': %s\n", fileID, err.Error())
 		http.Error(w, "file not found", 404)
 		return
 	}
+	defer f.Close()
 	w.Header().Set("Content-Disposition", "attachment; filename=\""+fileID+"\"")
-	n, err := w.Write(data)
-	if err != nil {
-		log.Printf("ERROR writing data to client '%s'\n", r.RemoteAddr)
-		http.Error(w, err.Error(), 500)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	// the fileID identifies the content, so it makes a strong ETag
+	w.Header().Set("ETag", "\""+fileID+"\"")
+	http.ServeContent(w, r, fileID, info.ModTime, f)
+	// resumed downloads are not counted again
+	if r.Method == "GET" && r.Header.Get("Range") == "" {
+		err = metaStore.Update(filePath, func(meta *storage.Meta) {
+			meta.Downloads++
+		})
+		if err != nil && Debug {
+			log.Printf("could not count download of '%s': %s\n", fileID, err.Error())
+		}
+	}
+	log.Printf("sent '%s' to client (Range: '%s')\n", fileID, r.Header.Get("Range"))
+}
+
+// Acknowledge is called by the recipient after a file has been downloaded
+// and decrypted successfully, the file is erased from the server.
+func Acknowledge(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID := vars["UserID"]
+	fileID := vars["FileID"]
+	filePath := fileKey(userID, fileID)
+	if _, err := fileMeta(filePath); err != nil {
+		http.Error(w, "file not found", 404)
 		return
 	}
-	log.Printf("written %d byte to client\n", n)
-	err = store.Erase(filePath)
+	err := eraseFile(filePath)
 	if err != nil {
 		log.Printf("ERROR erase file after download")
 		http.Error(w, err.Error(), 500)
 		return
 	}
+	log.Printf("file '%s' acknowledged and erased\n", fileID)
 }
@@ -0,0 +1,313 @@
+// quotas - limits for the size of uploads, inboxes and daily uploads
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxFormValueSize limits the form values of an upload, like the
+// recipientList, which are kept in memory.
+const maxFormValueSize = 1 << 20
+
+// quotaError refuses an upload that exceeds a limit, Status is the HTTP
+// status it is answered with.
+type quotaError struct {
+	Status int
+	Msg    string
+}
+
+func (e *quotaError) Error() string {
+	return e.Msg
+}
+
+// send answers the request with the error
+func (e *quotaError) send(w http.ResponseWriter) {
+	http.Error(w, e.Msg, e.Status)
+}
+
+func errTooLarge() *quotaError {
+	return &quotaError{http.StatusRequestEntityTooLarge,
+		fmt.Sprintf("file is larger than %d byte", cfg.MaxUploadSize)}
+}
+
+func errDailyLimit() *quotaError {
+	return &quotaError{http.StatusInsufficientStorage,
+		fmt.Sprintf("daily upload limit of %d byte reached", cfg.DailyUploadLimit)}
+}
+
+func errInboxFull(username string) *quotaError {
+	return &quotaError{http.StatusInsufficientStorage,
+		fmt.Sprintf("inbox of '%s' is full", username)}
+}
+
+// sentKey is the key the daily upload counts are kept under in the store,
+// so a restart does not reset them.
+const sentKey = ".quota/sent"
+
+// sentCounts are the bytes every user uploaded on Day (UTC)
+type sentCounts struct {
+	Day   time.Time
+	Bytes map[string]int64
+}
+
+var sent = struct {
+	sync.Mutex
+	loaded bool
+	sentCounts
+}{}
+
+// loadSent reads the counts saved by saveSent
+func loadSent() (counts sentCounts, err error) {
+	o, err := store.Get(sentKey)
+	if os.IsNotExist(err) {
+		return counts, nil
+	}
+	if err != nil {
+		return
+	}
+	defer o.Close()
+	data, err := ioutil.ReadAll(o)
+	if err != nil {
+		return
+	}
+	err = yaml.Unmarshal(data, &counts)
+	return
+}
+
+func saveSent(counts sentCounts) (err error) {
+	data, err := yaml.Marshal(counts)
+	if err != nil {
+		return
+	}
+	return store.Put(sentKey, bytes.NewReader(data))
+}
+
+// todaysCounts returns the bytes every user uploaded today, sent must be
+// locked.
+func todaysCounts() map[string]int64 {
+	if !sent.loaded {
+		counts, err := loadSent()
+		if err != nil {
+			log.Printf("ERROR reading daily upload counts: %s\n", err.Error())
+		}
+		sent.sentCounts = counts
+		sent.loaded = true
+	}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	if !today.Equal(sent.Day) || sent.Bytes == nil {
+		sent.Day = today
+		sent.Bytes = make(map[string]int64)
+	}
+	return sent.Bytes
+}
+
+// sentToday returns the bytes username uploaded today
+func sentToday(username string) int64 {
+	sent.Lock()
+	defer sent.Unlock()
+	return todaysCounts()[username]
+}
+
+// addSent counts an upload of size byte by username. It fails if that
+// exceeds the daily upload limit, a negative size gives back a counted
+// upload.
+func addSent(username string, size int64) (ok bool) {
+	sent.Lock()
+	defer sent.Unlock()
+	counts := todaysCounts()
+	if size > 0 && cfg.DailyUploadLimit > 0 && counts[username]+size > cfg.DailyUploadLimit {
+		return false
+	}
+	counts[username] += size
+	if counts[username] <= 0 {
+		delete(counts, username)
+	}
+	err := saveSent(sent.sentCounts)
+	if err != nil {
+		log.Printf("ERROR saving daily upload counts: %s\n", err.Error())
+	}
+	return true
+}
+
+// inbox is the number and size of the files waiting for a user
+type inbox struct {
+	Files int
+	Bytes int64
+}
+
+// inboxes keeps the usage of every inbox, so quotas are checked without
+// reading the metadata of all files. It is counted once on startup, see
+// countInboxes, and kept up to date by deliverFile and eraseFile.
+var inboxes = struct {
+	sync.Mutex
+	usage map[string]*inbox
+}{usage: make(map[string]*inbox)}
+
+// countInboxes counts the files already stored for every user
+func countInboxes() (err error) {
+	keys, err := listFiles("")
+	if err != nil {
+		return
+	}
+	inboxes.Lock()
+	defer inboxes.Unlock()
+	inboxes.usage = make(map[string]*inbox)
+	for _, key := range keys {
+		meta, err := fileMeta(key)
+		if err != nil {
+			log.Printf("ERROR counting '%s': %s\n", key, err.Error())
+			continue
+		}
+		addToInbox(fileOwner(key), 1, meta.Size)
+	}
+	return nil
+}
+
+// addToInbox changes the usage of the inbox of a user, inboxes must be
+// locked.
+func addToInbox(username string, files int, bytes int64) {
+	u := inboxes.usage[username]
+	if u == nil {
+		u = new(inbox)
+		inboxes.usage[username] = u
+	}
+	u.Files += files
+	u.Bytes += bytes
+	if u.Files <= 0 {
+		delete(inboxes.usage, username)
+	}
+}
+
+// removedFromInbox counts a file of size byte that left the inbox of a user
+func removedFromInbox(username string, size int64) {
+	inboxes.Lock()
+	defer inboxes.Unlock()
+	addToInbox(username, -1, -size)
+}
+
+// inboxUsage returns the number and size of the files waiting for a user
+func inboxUsage(username string) (files int, bytes int64) {
+	inboxes.Lock()
+	defer inboxes.Unlock()
+	if u := inboxes.usage[username]; u != nil {
+		return u.Files, u.Bytes
+	}
+	return 0, 0
+}
+
+// uploadLimit returns the size of the largest file sender can upload to
+// recipients right now, -1 if there is no limit, and the error for files
+// larger than that.
+func uploadLimit(sender string, recipients []string) (limit int64, exceeded *quotaError) {
+	limit = -1
+	lower := func(n int64, err *quotaError) {
+		if n < 0 {
+			n = 0
+		}
+		if limit < 0 || n < limit {
+			limit = n
+			exceeded = err
+		}
+	}
+	if cfg.MaxUploadSize > 0 {
+		lower(cfg.MaxUploadSize, errTooLarge())
+	}
+	if cfg.DailyUploadLimit > 0 {
+		lower(cfg.DailyUploadLimit-sentToday(sender), errDailyLimit())
+	}
+	if cfg.InboxQuota <= 0 && cfg.InboxMaxFiles <= 0 {
+		return
+	}
+	for _, username := range recipients {
+		if !userDB.Lookup(username) {
+			continue
+		}
+		files, bytes := inboxUsage(username)
+		if cfg.InboxMaxFiles > 0 && files >= cfg.InboxMaxFiles {
+			lower(0, errInboxFull(username))
+		}
+		if cfg.InboxQuota > 0 {
+			lower(cfg.InboxQuota-bytes, errInboxFull(username))
+		}
+	}
+	return
+}
+
+// reserveQuota returns a *quotaError if a file of the given size, sent by
+// sender, exceeds a limit of the sender or of one of the recipients.
+// Otherwise the file is counted for all of them right away, so concurrent
+// uploads can not overrun a limit together. An upload failing later on
+// gives its reservation back with releaseQuota.
+func reserveQuota(sender string, recipients []string, size int64) (err error) {
+	if cfg.MaxUploadSize > 0 && size > cfg.MaxUploadSize {
+		return errTooLarge()
+	}
+	inboxes.Lock()
+	defer inboxes.Unlock()
+	for _, username := range recipients {
+		var files int
+		var bytes int64
+		if u := inboxes.usage[username]; u != nil {
+			files, bytes = u.Files, u.Bytes
+		}
+		if cfg.InboxMaxFiles > 0 && files+1 > cfg.InboxMaxFiles {
+			return errInboxFull(username)
+		}
+		if cfg.InboxQuota > 0 && bytes+size > cfg.InboxQuota {
+			return errInboxFull(username)
+		}
+	}
+	if !addSent(sender, size) {
+		return errDailyLimit()
+	}
+	for _, username := range recipients {
+		addToInbox(username, 1, size)
+	}
+	return nil
+}
+
+// releaseQuota gives back what reserveQuota counted for a file that was not
+// stored after all.
+func releaseQuota(sender string, recipients []string, size int64) {
+	addSent(sender, -size)
+	inboxes.Lock()
+	defer inboxes.Unlock()
+	for _, username := range recipients {
+		addToInbox(username, -1, -size)
+	}
+}
+
+// Usage tells a user how much of the limits is used, limits of 0 mean
+// there is no limit.
+type Usage struct {
+	Files            int   `json:"files"` // files waiting for the user
+	Bytes            int64 `json:"bytes"`
+	InboxMaxFiles    int   `json:"inboxMaxFiles"`
+	InboxQuota       int64 `json:"inboxQuota"`
+	SentToday        int64 `json:"sentToday"` // byte uploaded by the user today (UTC)
+	DailyUploadLimit int64 `json:"dailyUploadLimit"`
+	MaxUploadSize    int64 `json:"maxUploadSize"`
+}
+
+// GetUsage sends the usage of the authenticated user as JSON
+func GetUsage(w http.ResponseWriter, r *http.Request) {
+	username := r.Header.Get("Apiusername")
+	files, bytes := inboxUsage(username)
+	sendJSON(w, Usage{
+		Files:            files,
+		Bytes:            bytes,
+		InboxMaxFiles:    cfg.InboxMaxFiles,
+		InboxQuota:       cfg.InboxQuota,
+		SentToday:        sentToday(username),
+		DailyUploadLimit: cfg.DailyUploadLimit,
+		MaxUploadSize:    cfg.MaxUploadSize,
+	})
+}
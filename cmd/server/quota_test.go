@@ -0,0 +1,81 @@
+package main
+
+import (
+	"github.com/scusi/secureShare/libs/server/config"
+	"sync"
+	"testing"
+)
+
+func TestInboxCounts(t *testing.T) {
+	defer setupStore(t)()
+	cfg = config.New()
+	storeShared(t, "f1", "12345", "alice", "bob")
+	storeShared(t, "f2", "123", "alice")
+	err := countInboxes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files, bytes := inboxUsage("alice"); files != 2 || bytes != 8 {
+		t.Errorf("alice has %d files, %d byte, want 2 files, 8 byte", files, bytes)
+	}
+	// erasing a file twice counts it once
+	eraseFile(fileKey("alice", "f1"))
+	eraseFile(fileKey("alice", "f1"))
+	if files, bytes := inboxUsage("alice"); files != 1 || bytes != 3 {
+		t.Errorf("alice has %d files, %d byte, want 1 file, 3 byte", files, bytes)
+	}
+	if files, bytes := inboxUsage("bob"); files != 1 || bytes != 5 {
+		t.Errorf("bob has %d files, %d byte, want 1 file, 5 byte", files, bytes)
+	}
+}
+
+func TestReserveQuota(t *testing.T) {
+	defer setupStore(t)()
+	cfg = config.New()
+	cfg.InboxMaxFiles = 5
+	cfg.DailyUploadLimit = 0
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	reserved := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if reserveQuota("carol", []string{"alice", "bob"}, 10) == nil {
+				mu.Lock()
+				reserved++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if reserved != cfg.InboxMaxFiles {
+		t.Errorf("%d concurrent uploads reserved, want %d", reserved, cfg.InboxMaxFiles)
+	}
+	if files, _ := inboxUsage("bob"); files != cfg.InboxMaxFiles {
+		t.Errorf("bob has %d files, want %d", files, cfg.InboxMaxFiles)
+	}
+	releaseQuota("carol", []string{"alice", "bob"}, 10)
+	if files, bytes := inboxUsage("alice"); files != 4 || bytes != 40 {
+		t.Errorf("alice has %d files, %d byte after a release, want 4 files, 40 byte", files, bytes)
+	}
+	if n := sentToday("carol"); n != 40 {
+		t.Errorf("carol sent %d byte, want 40", n)
+	}
+}
+
+func TestReserveDailyLimit(t *testing.T) {
+	defer setupStore(t)()
+	cfg = config.New()
+	cfg.DailyUploadLimit = 100
+	if err := reserveQuota("carol", []string{"alice"}, 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := reserveQuota("carol", []string{"alice"}, 60); err == nil {
+		t.Error("daily upload limit exceeded")
+	}
+	// a refused upload reserves nothing
+	if files, _ := inboxUsage("alice"); files != 1 {
+		t.Errorf("alice has %d files, want 1", files)
+	}
+}
@@ -0,0 +1,281 @@
+// rate limits - token buckets per client IP and user, lockout after failed logins
+package main
+
+import (
+	"fmt"
+	"github.com/scusi/secureShare/libs/server/config"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxBuckets is the number of clients tracked per limiter before buckets
+// that are full again are dropped.
+const maxBuckets = 10000
+
+// bucket holds the requests left for a client
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter is a token bucket rate limiter with one bucket per client
+type limiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens added per second
+	burst   float64 // size of the bucket
+	buckets map[string]*bucket
+}
+
+func newLimiter(l config.RateLimit) *limiter {
+	burst := float64(l.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{
+		rate:    float64(l.PerMinute) / 60,
+		burst:   burst,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow takes a token from the bucket of key. If there is none left it
+// reports when the next one is available.
+func (l *limiter) allow(key string) (ok bool, retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	b := l.buckets[key]
+	if b == nil {
+		if len(l.buckets) >= maxBuckets {
+			l.prune(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	} else {
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// prune drops the buckets that are full again, they are the same as no
+// bucket at all. The caller holds the lock.
+func (l *limiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimitRoutes are the routes limits can be configured for
+var rateLimitRoutes = []string{"register", "lookup", "upload", "session", "download", "api"}
+
+// limiters holds the limiter of every route that has a limit
+var limiters = make(map[string]*limiter)
+
+// setupRateLimits creates the limiters for cfg.RateLimits
+func setupRateLimits() (err error) {
+	for route, l := range cfg.RateLimits {
+		known := false
+		for _, r := range rateLimitRoutes {
+			known = known || r == route
+		}
+		if !known {
+			return fmt.Errorf("unknown route '%s' in ratelimits, use one of %s", route, strings.Join(rateLimitRoutes, ", "))
+		}
+		if l.PerMinute > 0 {
+			limiters[route] = newLimiter(l)
+		}
+	}
+	return nil
+}
+
+// clientIP returns the IP address of the client, as seen by a reverse proxy
+// if cfg.RealIPHeader is set.
+func clientIP(r *http.Request) string {
+	if cfg.RealIPHeader != "" {
+		if v := r.Header.Get(cfg.RealIPHeader); v != "" {
+			// the proxy appends the address, earlier ones may be made up
+			addrs := strings.Split(v, ",")
+			return strings.TrimSpace(addrs[len(addrs)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// distinctClient reports whether the IP of the client of r tells it apart
+// from other clients. Clients of a Tor onion service, or of a proxy that
+// does not set cfg.RealIPHeader, all connect from a loopback address.
+func distinctClient(r *http.Request) bool {
+	ip := net.ParseIP(clientIP(r))
+	return ip != nil && !ip.IsLoopback()
+}
+
+// tooManyRequests tells the client to come back after retryAfter
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", seconds))
+	http.Error(w, "too many requests, try again later", http.StatusTooManyRequests)
+}
+
+// allowRequest takes a token for key from the limiter of route, it answers
+// the request with 429 if there is none.
+func allowRequest(w http.ResponseWriter, route, key string) bool {
+	l := limiters[route]
+	if l == nil {
+		return true
+	}
+	ok, retryAfter := l.allow(key)
+	if !ok {
+		log.Printf("rate limit of '%s' hit by %s\n", route, key)
+		tooManyRequests(w, retryAfter)
+	}
+	return ok
+}
+
+// Limited wraps a handler with the rate limit of route per client IP.
+// Clients that can not be told apart by their IP share one bucket.
+func Limited(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowRequest(w, route, "ip "+clientIP(r)) {
+			return
+		}
+		h(w, r)
+	}
+}
+
+// Protected wraps a handler that needs valid API credentials, see
+// Authenticated, with the rate limit of route per client IP and per user.
+// The limit per client IP is only applied if clients can be told apart by
+// their IP, otherwise they would all share one bucket.
+func Protected(route string, h http.HandlerFunc) http.HandlerFunc {
+	authenticated := Authenticated(func(w http.ResponseWriter, r *http.Request) {
+		if !allowRequest(w, route, "user "+r.Header.Get("Apiusername")) {
+			return
+		}
+		h(w, r)
+	})
+	return func(w http.ResponseWriter, r *http.Request) {
+		if distinctClient(r) && !allowRequest(w, route, "ip "+clientIP(r)) {
+			return
+		}
+		authenticated(w, r)
+	}
+}
+
+// failures counts the failed authentications of a client
+type failures struct {
+	count       int
+	first       time.Time // time of the first failure counted
+	lockedUntil time.Time
+}
+
+var authFailures = struct {
+	sync.Mutex
+	m map[string]*failures
+}{m: make(map[string]*failures)}
+
+// userLockoutKey returns the key failed authentications to the user API are
+// counted under, ok is false if they are not counted. Clients are told
+// apart by their IP only, a username in the key would let a client lock
+// out any user it names. Clients sharing an address, like those of a Tor
+// onion service, are not locked out at all, that would lock out all of
+// them. The random 256 bit tokens can not be guessed anyway.
+func userLockoutKey(r *http.Request) (key string, ok bool) {
+	if !distinctClient(r) {
+		return "", false
+	}
+	return "user " + clientIP(r), true
+}
+
+// adminLockoutKey returns the key failed authentications to the admin API
+// are counted under. They are counted apart from those to the user API, so
+// failed user logins never lock out the admin.
+func adminLockoutKey(r *http.Request) string {
+	return "admin " + clientIP(r)
+}
+
+// lockedOut reports whether the client counted under key is locked out and
+// for how long.
+func lockedOut(key string) (locked bool, retryAfter time.Duration) {
+	if cfg.AuthFailures <= 0 {
+		return false, 0
+	}
+	authFailures.Lock()
+	defer authFailures.Unlock()
+	f := authFailures.m[key]
+	if f == nil {
+		return false, 0
+	}
+	retryAfter = time.Until(f.lockedUntil)
+	return retryAfter > 0, retryAfter
+}
+
+// authFailed counts a failed authentication of the client counted under
+// key. After cfg.AuthFailures failures within cfg.LockoutTime the client is
+// locked out for cfg.LockoutTime.
+func authFailed(key string) {
+	if cfg.AuthFailures <= 0 {
+		return
+	}
+	authFailures.Lock()
+	defer authFailures.Unlock()
+	now := time.Now()
+	f := authFailures.m[key]
+	if f == nil && len(authFailures.m) >= maxBuckets {
+		pruneFailures(now)
+	}
+	if f == nil || now.Sub(f.first) > cfg.LockoutTime {
+		f = &failures{first: now}
+		authFailures.m[key] = f
+	}
+	f.count++
+	if f.count >= cfg.AuthFailures {
+		f.lockedUntil = now.Add(cfg.LockoutTime)
+		f.count = 0
+		f.first = now
+		log.Printf("%s locked out after %d failed authentications\n", key, cfg.AuthFailures)
+	}
+}
+
+// pruneFailures drops the failures that are no longer counted. If that does
+// not make room, clients that are not locked out are forgotten, so the map
+// never holds more than maxBuckets clients. The caller holds the lock.
+func pruneFailures(now time.Time) {
+	for key, f := range authFailures.m {
+		if now.Sub(f.first) > cfg.LockoutTime && now.After(f.lockedUntil) {
+			delete(authFailures.m, key)
+		}
+	}
+	for key, f := range authFailures.m {
+		if len(authFailures.m) < maxBuckets {
+			return
+		}
+		if now.After(f.lockedUntil) {
+			delete(authFailures.m, key)
+		}
+	}
+	for key := range authFailures.m {
+		if len(authFailures.m) < maxBuckets {
+			return
+		}
+		delete(authFailures.m, key)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"github.com/scusi/secureShare/libs/server/config"
+	"github.com/scusi/secureShare/libs/server/user"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// setupLockout configures a lockout after 3 failures, with an empty user
+// database.
+func setupLockout(t *testing.T) (cleanup func()) {
+	dir, err := ioutil.TempDir("", "lockout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = config.New()
+	cfg.AuthFailures = 3
+	cfg.LockoutTime = time.Minute
+	cfg.AdminToken = "admin token"
+	udb := &user.UserDB{Path: filepath.Join(dir, "users.yml")}
+	err = udb.Save("")
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	userDB = udb
+	authFailures.m = make(map[string]*failures)
+	return func() { os.RemoveAll(dir) }
+}
+
+// status sends a request from remoteAddr with the given headers to h
+func status(h http.HandlerFunc, remoteAddr string, header map[string]string) int {
+	r := httptest.NewRequest("GET", "/usage", nil)
+	r.RemoteAddr = remoteAddr
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w.Code
+}
+
+func ok(w http.ResponseWriter, r *http.Request) {}
+
+func TestUserFailuresDoNotLockOutAdmin(t *testing.T) {
+	defer setupLockout(t)()
+	userAPI := Authenticated(ok)
+	adminAPI := AdminAuthenticated(ok)
+	admin := map[string]string{"Admintoken": cfg.AdminToken}
+	for _, addr := range []string{"127.0.0.1:4000", "192.0.2.1:4000"} {
+		for i := 0; i < 3*cfg.AuthFailures; i++ {
+			status(userAPI, addr, nil)
+			status(userAPI, addr, map[string]string{"Apiusername": "alice", "Apikey": "guess"})
+			status(userAPI, addr, map[string]string{"Apiusername": fmt.Sprintf("user%d", i), "Apikey": "guess"})
+		}
+		if code := status(adminAPI, addr, admin); code != 200 {
+			t.Errorf("admin API from %s answered %d after failed user logins, want 200", addr, code)
+		}
+	}
+	// only the distinct client was locked out of the user API
+	if code := status(userAPI, "192.0.2.1:4000", nil); code != http.StatusTooManyRequests {
+		t.Errorf("user API from a locked out IP answered %d, want 429", code)
+	}
+	if code := status(userAPI, "127.0.0.1:4000", nil); code != http.StatusUnauthorized {
+		t.Errorf("user API from a shared address answered %d, want 401", code)
+	}
+}
+
+func TestAdminLockout(t *testing.T) {
+	defer setupLockout(t)()
+	adminAPI := AdminAuthenticated(ok)
+	for i := 0; i < cfg.AuthFailures; i++ {
+		if code := status(adminAPI, "127.0.0.1:4000", map[string]string{"Admintoken": "guess"}); code != http.StatusUnauthorized {
+			t.Fatalf("wrong admin token answered %d, want 401", code)
+		}
+	}
+	if code := status(adminAPI, "127.0.0.1:4000", map[string]string{"Admintoken": cfg.AdminToken}); code != http.StatusTooManyRequests {
+		t.Errorf("admin API answered %d after %d failures, want 429", code, cfg.AuthFailures)
+	}
+	// the user API is not affected
+	if code := status(Authenticated(ok), "192.0.2.1:4000", nil); code != http.StatusUnauthorized {
+		t.Errorf("user API answered %d, want 401", code)
+	}
+}
+
+func TestLockoutDoesNotTargetUsers(t *testing.T) {
+	defer setupLockout(t)()
+	userAPI := Authenticated(ok)
+	// one IP guessing for alice locks out itself, not alice
+	for i := 0; i < cfg.AuthFailures; i++ {
+		status(userAPI, "192.0.2.1:4000", map[string]string{"Apiusername": "alice", "Apikey": "guess"})
+	}
+	if code := status(userAPI, "192.0.2.1:4000", map[string]string{"Apiusername": "bob", "Apikey": "guess"}); code != http.StatusTooManyRequests {
+		t.Errorf("locked out IP answered %d for another username, want 429", code)
+	}
+	if code := status(userAPI, "192.0.2.2:4000", map[string]string{"Apiusername": "alice", "Apikey": "guess"}); code != http.StatusUnauthorized {
+		t.Errorf("another IP answered %d for 'alice', want 401", code)
+	}
+}
+
+func TestLockoutMapIsCapped(t *testing.T) {
+	defer setupLockout(t)()
+	for i := 0; i < maxBuckets+100; i++ {
+		authFailed(fmt.Sprintf("user 10.%d.%d.%d", i>>16&255, i>>8&255, i&255))
+	}
+	if n := len(authFailures.m); n > maxBuckets {
+		t.Errorf("%d clients tracked, want at most %d", n, maxBuckets)
+	}
+}
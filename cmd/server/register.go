@@ -0,0 +1,215 @@
+// registration - users prove to own the key they register with
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/cathalgarvey/go-minilock"
+	"github.com/cathalgarvey/go-minilock/taber"
+	"github.com/scusi/secureShare/libs/server/common"
+	"github.com/scusi/secureShare/libs/server/user"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TokenContentType is the media type of a minilock encrypted API token, or
+// of a minilock encrypted registration challenge
+const TokenContentType = "application/x-minilock"
+
+// challengeTTL is the time a client has to answer a registration challenge
+const challengeTTL = 5 * time.Minute
+
+// maxPendingRegistrations limits the number of unanswered challenges
+const maxPendingRegistrations = 10000
+
+// registration modes of the server, see config.Config.RegistrationMode
+const (
+	RegistrationOpen     = "open"     // everybody can register
+	RegistrationInvite   = "invite"   // registering needs an invite code
+	RegistrationApproval = "approval" // new accounts wait for an admin to approve them
+)
+
+// AccountStatusHeader tells a registering client whether its new account
+// can be used right away ("active") or waits for approval ("pending").
+const AccountStatusHeader = "Account-Status"
+
+// invites holds the unused invite codes of the invite mode
+var invites *user.Invites
+
+// checkRegistrationMode makes sure cfg.RegistrationMode is known and loads
+// the invites. Admins can create invites in every mode.
+func checkRegistrationMode() (err error) {
+	switch cfg.RegistrationMode {
+	case RegistrationOpen, RegistrationInvite, RegistrationApproval:
+	default:
+		return fmt.Errorf("unknown registration mode '%s'", cfg.RegistrationMode)
+	}
+	log.Printf("registration mode: %s\n", cfg.RegistrationMode)
+	invites, err = user.LoadInvites(cfg.InvitesFile)
+	return
+}
+
+// challenge is a registration waiting for the client to prove it owns the
+// private key of pubID.
+type challenge struct {
+	username string
+	pubID    string
+	keys     *taber.Keys // public key of pubID
+	invite   string      // invite code, used up once the registration is confirmed
+	expires  time.Time
+}
+
+// pendingRegistrations holds the open challenges by their hex encoded
+// nonce, several clients can register the same username at once. The first
+// one to answer its challenge gets the account.
+var pendingRegistrations = struct {
+	sync.Mutex
+	m map[string]*challenge
+}{m: make(map[string]*challenge)}
+
+// Register is the first step of a registration. It checks username and
+// pubID and sends a random nonce, encrypted to pubID. The account is created
+// by ConfirmRegistration, once the client sent the decrypted nonce back.
+// In invite mode the form value 'invite' has to be a valid invite code.
+func Register(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Register -->")
+	username := r.FormValue("username")
+	pubID := r.FormValue("pubID")
+	invite := r.FormValue("invite")
+	if Debug {
+		log.Printf("username: '%s', pubID: '%s'", username, pubID)
+	}
+	if username == "" {
+		http.Error(w, "'username' not supplied", 400)
+		return
+	}
+	// the server knows users only by a salted hash of their encodeID
+	if _, err := common.VerifyUsername(username); err != nil {
+		http.Error(w, "invalid username: "+err.Error(), 400)
+		return
+	}
+	// pubID has to be a syntactical valid minilock ID
+	userKeys, err := taber.FromID(pubID)
+	if err != nil {
+		http.Error(w, "invalid pubID", 400)
+		return
+	}
+	if userDB.Lookup(username) {
+		http.Error(w, "User already existing", 500)
+		return
+	}
+	// check the invite early, it is used up by ConfirmRegistration
+	if cfg.RegistrationMode == RegistrationInvite && !invites.Valid(invite) {
+		log.Printf("registration of '%s' without a valid invite\n", username)
+		http.Error(w, "registration needs a valid invite code", 403)
+		return
+	}
+	c := &challenge{
+		username: username,
+		pubID:    pubID,
+		keys:     userKeys,
+		invite:   invite,
+		expires:  time.Now().Add(challengeTTL),
+	}
+	nonce := make([]byte, 32)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		log.Printf("ERROR generating challenge: %s\n", err.Error())
+		http.Error(w, "could not create challenge", 500)
+		return
+	}
+	// only the owner of pubID can read the nonce
+	encryptedNonce, err := minilock.EncryptFileContents("challenge", nonce, challengeKeys, userKeys)
+	if err != nil {
+		log.Printf("ERROR encrypting challenge for '%s': %s\n", username, err.Error())
+		http.Error(w, "could not create challenge", 500)
+		return
+	}
+	pendingRegistrations.Lock()
+	now := time.Now()
+	for key, pending := range pendingRegistrations.m {
+		if now.After(pending.expires) {
+			delete(pendingRegistrations.m, key)
+		}
+	}
+	if len(pendingRegistrations.m) >= maxPendingRegistrations {
+		pendingRegistrations.Unlock()
+		http.Error(w, "too many pending registrations, try again later", 503)
+		return
+	}
+	pendingRegistrations.m[hex.EncodeToString(nonce)] = c
+	pendingRegistrations.Unlock()
+	log.Printf("sent registration challenge for '%s'\n", username)
+	w.Header().Set("Content-Type", TokenContentType)
+	w.Write(encryptedNonce)
+}
+
+// ConfirmRegistration creates the account of a user who sent back the
+// decrypted nonce of the challenge, hex encoded in the form value 'nonce'.
+// The API token of the new account is sent encrypted to the users pubID, if
+// the server has a minilock identity. In approval mode the account can not
+// be used before an admin approved it, see AccountStatusHeader.
+func ConfirmRegistration(w http.ResponseWriter, r *http.Request) {
+	username := r.FormValue("username")
+	nonce, err := hex.DecodeString(r.FormValue("nonce"))
+	if err != nil {
+		http.Error(w, "invalid nonce", 400)
+		return
+	}
+	key := hex.EncodeToString(nonce)
+	pendingRegistrations.Lock()
+	c := pendingRegistrations.m[key]
+	if c != nil && time.Now().After(c.expires) {
+		delete(pendingRegistrations.m, key)
+		c = nil
+	}
+	if c == nil || c.username != username {
+		pendingRegistrations.Unlock()
+		log.Printf("wrong challenge response for '%s'\n", username)
+		http.Error(w, "no pending registration for this challenge response", 404)
+		return
+	}
+	delete(pendingRegistrations.m, key)
+	pendingRegistrations.Unlock()
+
+	if userDB.Lookup(username) {
+		http.Error(w, "User already existing", 500)
+		return
+	}
+	if cfg.RegistrationMode == RegistrationInvite {
+		// two registrations may have started with the same invite
+		err = invites.Use(c.invite)
+		if err != nil {
+			http.Error(w, "registration needs a valid invite code", 403)
+			return
+		}
+	}
+	log.Printf("going to add new user '%s'\n", username)
+	token, err := userDB.Add(username, c.pubID)
+	if err != nil {
+		log.Printf("ERROR adding user '%s': %s\n", username, err.Error())
+		http.Error(w, "adding user failed", 500)
+		return
+	}
+	status := "active"
+	if cfg.RegistrationMode == RegistrationApproval {
+		// the token is not sent yet, nobody can use the account in between
+		err = userDB.Update(username, func(u *user.User) error {
+			u.Pending = true
+			return nil
+		})
+		if err != nil {
+			log.Printf("ERROR marking user '%s' pending: %s\n", username, err.Error())
+			userDB.Delete(username)
+			http.Error(w, "adding user failed", 500)
+			return
+		}
+		status = "pending"
+		log.Printf("user '%s' waits for approval\n", username)
+	}
+	w.Header().Set(AccountStatusHeader, status)
+	sendToken(w, username, token, c.keys)
+}
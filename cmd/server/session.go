@@ -0,0 +1,316 @@
+// upload sessions - chunked, resumable uploads
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sessionDir is the directory below DataDir where upload sessions are kept
+// until they are committed.
+const sessionDir = ".sessions"
+
+var sessionIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// UploadSession describes an upload that is transferred in chunks.
+// The data received so far is kept next to the session file, its size is
+// the offset the next chunk has to start at.
+type UploadSession struct {
+	ID            string        // random ID of the session
+	Owner         string        // username of the uploading user
+	RecipientList []string      // usernames the file is going to be delivered to
+	TTL           time.Duration // time the file is kept after the session is committed
+	Created       time.Time     // time the session was created
+}
+
+// sessionLocks serializes requests for the same session
+var sessionLocks = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex
+}{m: make(map[string]*sync.Mutex)}
+
+func lockSession(id string) (unlock func()) {
+	sessionLocks.Lock()
+	l, ok := sessionLocks.m[id]
+	if !ok {
+		l = new(sync.Mutex)
+		sessionLocks.m[id] = l
+	}
+	sessionLocks.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+func sessionPath(id string) string {
+	return filepath.Join(cfg.DataDir, sessionDir, id+".yml")
+}
+
+func sessionDataPath(id string) string {
+	return filepath.Join(cfg.DataDir, sessionDir, id+".data")
+}
+
+func newSessionID() (id string, err error) {
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		return
+	}
+	return fmt.Sprintf("%x", b), nil
+}
+
+func loadSession(id string) (s *UploadSession, err error) {
+	if !sessionIDPattern.MatchString(id) {
+		return nil, fmt.Errorf("invalid session ID")
+	}
+	data, err := ioutil.ReadFile(sessionPath(id))
+	if err != nil {
+		return
+	}
+	s = new(UploadSession)
+	err = yaml.Unmarshal(data, s)
+	return
+}
+
+func saveSession(s *UploadSession) (err error) {
+	data, err := yaml.Marshal(s)
+	if err != nil {
+		return
+	}
+	return ioutil.WriteFile(sessionPath(s.ID), data, 0600)
+}
+
+// removeSession removes the files and the lock of a session, callers hold
+// the lock. Requests waiting for it find the session gone.
+func removeSession(id string) {
+	os.Remove(sessionDataPath(id))
+	os.Remove(sessionPath(id))
+	sessionLocks.Lock()
+	delete(sessionLocks.m, id)
+	sessionLocks.Unlock()
+}
+
+// sessionOffset returns the number of bytes received for a session so far
+func sessionOffset(id string) (offset int64, err error) {
+	fi, err := os.Stat(sessionDataPath(id))
+	if err != nil {
+		return
+	}
+	return fi.Size(), nil
+}
+
+// sessionFromRequest loads the session named in the request and makes sure
+// it belongs to the requesting user. On failure an error is sent to the
+// client and nil is returned.
+func sessionFromRequest(w http.ResponseWriter, r *http.Request) *UploadSession {
+	s, err := loadSession(mux.Vars(r)["SessionID"])
+	if err != nil {
+		if Debug {
+			log.Printf("ERROR loading session: %s\n", err.Error())
+		}
+		http.Error(w, "session not found", 404)
+		return nil
+	}
+	if s.Owner != r.Header.Get("Apiusername") {
+		http.Error(w, "session not found", 404)
+		return nil
+	}
+	return s
+}
+
+// CreateSession starts a new upload session for the recipients given in the
+// 'recipientList' form value and returns the ID of the session.
+func CreateSession(w http.ResponseWriter, r *http.Request) {
+	recipientList := parseRecipientList(r.FormValue("recipientList"))
+	if len(recipientList) == 0 {
+		http.Error(w, "'recipientList' not supplied", 400)
+		return
+	}
+	if userNames, unknown := existingUsers(recipientList); len(userNames) == 0 {
+		http.Error(w, unknown.Error(), http.StatusBadRequest)
+		return
+	}
+	ttl, err := uploadTTL(r.FormValue("ttl"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	// no need to upload anything if not even a byte would be accepted
+	if limit, exceeded := uploadLimit(r.Header.Get("Apiusername"), recipientList); limit == 0 {
+		exceeded.send(w)
+		return
+	}
+	id, err := newSessionID()
+	if err != nil {
+		log.Printf("ERROR generating session ID: %s\n", err.Error())
+		http.Error(w, "could not create session", 500)
+		return
+	}
+	s := &UploadSession{
+		ID:            id,
+		Owner:         r.Header.Get("Apiusername"),
+		RecipientList: recipientList,
+		TTL:           ttl,
+		Created:       time.Now(),
+	}
+	err = os.MkdirAll(filepath.Join(cfg.DataDir, sessionDir), 0700)
+	if err == nil {
+		err = ioutil.WriteFile(sessionDataPath(id), nil, 0600)
+	}
+	if err == nil {
+		err = saveSession(s)
+	}
+	if err != nil {
+		log.Printf("ERROR creating session: %s\n", err.Error())
+		removeSession(id)
+		http.Error(w, "could not create session", 500)
+		return
+	}
+	log.Printf("upload session '%s' created\n", id)
+	fmt.Fprintf(w, "%s", id)
+}
+
+// SessionOffset returns the offset the next chunk of a session has to be
+// uploaded at.
+func SessionOffset(w http.ResponseWriter, r *http.Request) {
+	s := sessionFromRequest(w, r)
+	if s == nil {
+		return
+	}
+	offset, err := sessionOffset(s.ID)
+	if err != nil {
+		http.Error(w, "session not found", 404)
+		return
+	}
+	fmt.Fprintf(w, "%d", offset)
+}
+
+// PutChunk appends the request body to the session data at the given offset.
+// The offset must not be beyond the data received so far, data after the
+// offset is replaced. The new offset is returned to the client. Chunks that
+// would make the file larger than cfg.MaxUploadSize are refused.
+func PutChunk(w http.ResponseWriter, r *http.Request) {
+	s := sessionFromRequest(w, r)
+	if s == nil {
+		return
+	}
+	offset, err := strconv.ParseInt(mux.Vars(r)["Offset"], 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "invalid offset", 400)
+		return
+	}
+	unlock := lockSession(s.ID)
+	defer unlock()
+	current, err := sessionOffset(s.ID)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// removed while waiting for the lock, which is dropped again
+			removeSession(s.ID)
+		}
+		http.Error(w, "session not found", 404)
+		return
+	}
+	if offset > current {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "%d", current)
+		return
+	}
+	f, err := os.OpenFile(sessionDataPath(s.ID), os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("ERROR opening session data: %s\n", err.Error())
+		http.Error(w, "could not write chunk", 500)
+		return
+	}
+	defer f.Close()
+	err = f.Truncate(offset)
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		log.Printf("ERROR preparing session data: %s\n", err.Error())
+		http.Error(w, "could not write chunk", 500)
+		return
+	}
+	var body io.Reader = r.Body
+	if cfg.MaxUploadSize > 0 {
+		body = io.LimitReader(r.Body, cfg.MaxUploadSize-offset+1)
+	}
+	n, err := io.Copy(f, body)
+	if err == nil && cfg.MaxUploadSize > 0 && offset+n > cfg.MaxUploadSize {
+		f.Truncate(offset)
+		errTooLarge().send(w)
+		return
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		// keep what was received, the client resumes from there
+		log.Printf("ERROR receiving chunk for session '%s': %s\n", s.ID, err.Error())
+		http.Error(w, "could not write chunk", 500)
+		return
+	}
+	fmt.Fprintf(w, "%d", offset+n)
+}
+
+// CommitSession finishes an upload session. The assembled data is delivered
+// to the recipients of the session under a new fileID.
+func CommitSession(w http.ResponseWriter, r *http.Request) {
+	s := sessionFromRequest(w, r)
+	if s == nil {
+		return
+	}
+	unlock := lockSession(s.ID)
+	defer unlock()
+	dataPath := sessionDataPath(s.ID)
+	f, err := os.Open(dataPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// removed while waiting for the lock, which is dropped again
+			removeSession(s.ID)
+		}
+		http.Error(w, "session not found", 404)
+		return
+	}
+	h := newFileHasher()
+	_, err = io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		log.Printf("ERROR hashing session data: %s\n", err.Error())
+		http.Error(w, "could not commit session", 500)
+		return
+	}
+	meta := h.Meta()
+	meta.Sender = s.Owner
+	fileID, err := deliverFile(dataPath, meta, s.RecipientList, s.TTL)
+	if qe, ok := err.(*quotaError); ok {
+		log.Printf("session '%s' refused: %s\n", s.ID, qe.Error())
+		qe.send(w)
+		return
+	}
+	if unknown, ok := err.(unknownRecipientsError); ok {
+		// the recipients were deleted meanwhile, retrying does not help
+		removeSession(s.ID)
+		http.Error(w, unknown.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR storing session '%s': %s\n", s.ID, err.Error())
+		http.Error(w, "could not commit session", 500)
+		return
+	}
+	removeSession(s.ID)
+	log.Printf("upload session '%s' committed as '%s'\n", s.ID, fileID)
+	fmt.Fprintf(w, "%s", fileID)
+}
@@ -0,0 +1,123 @@
+// API tokens - users manage the tokens of their devices
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/cathalgarvey/go-minilock"
+	"github.com/cathalgarvey/go-minilock/taber"
+	"log"
+	"net/http"
+	"time"
+)
+
+// TokenInfo describes an API token of a user, the token itself is never
+// sent again after it was issued.
+type TokenInfo struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Current bool      `json:"current"` // token used for the request
+}
+
+// sendToken sends a newly issued token of username, encrypted to the keys
+// of the user, so only the user can read it. Servers without keys send it
+// in clear.
+func sendToken(w http.ResponseWriter, username, token string, keys *taber.Keys) {
+	if serverKeys == nil {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "%s", token)
+		return
+	}
+	encryptedToken, err := minilock.EncryptFileContents("apitoken", []byte(token), serverKeys, keys)
+	if err != nil {
+		log.Printf("ERROR encrypting token for '%s': %s\n", username, err.Error())
+		http.Error(w, "could not encrypt token", 500)
+		return
+	}
+	w.Header().Set("Content-Type", TokenContentType)
+	w.Write(encryptedToken)
+}
+
+// sendUserToken sends a newly issued token of an existing user, see
+// sendToken.
+func sendUserToken(w http.ResponseWriter, username, token string) {
+	keys, err := taber.FromID(userDB.PublicKey(username))
+	if err != nil {
+		log.Printf("ERROR reading public key of '%s': %s\n", username, err.Error())
+		http.Error(w, "could not encrypt token", 500)
+		return
+	}
+	sendToken(w, username, token, keys)
+}
+
+// ListTokens sends the tokens of the user as JSON
+func ListTokens(w http.ResponseWriter, r *http.Request) {
+	username := r.Header.Get("Apiusername")
+	current, _ := userDB.TokenName(username, r.Header.Get("Apikey"))
+	tokens, err := userDB.Tokens(username)
+	if err != nil {
+		log.Printf("ERROR listing tokens of '%s': %s\n", username, err.Error())
+		http.Error(w, "could not list tokens", 500)
+		return
+	}
+	list := []TokenInfo{}
+	for _, t := range tokens {
+		list = append(list, TokenInfo{Name: t.Name, Created: t.Created, Current: t.Name == current})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// CreateToken issues a new token with the name given in the form value
+// 'name' and sends it to the user, encrypted like the token sent at the
+// registration.
+func CreateToken(w http.ResponseWriter, r *http.Request) {
+	username := r.Header.Get("Apiusername")
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "'name' not supplied", 400)
+		return
+	}
+	token, err := userDB.CreateToken(username, name)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	log.Printf("token '%s' created for '%s'\n", name, username)
+	sendUserToken(w, username, token)
+}
+
+// RotateToken replaces the token named in the form value 'name', or the
+// token used for the request if no name is given, and sends the new token.
+func RotateToken(w http.ResponseWriter, r *http.Request) {
+	username := r.Header.Get("Apiusername")
+	name := r.FormValue("name")
+	if name == "" {
+		name, _ = userDB.TokenName(username, r.Header.Get("Apikey"))
+	}
+	token, err := userDB.RotateToken(username, name)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	log.Printf("token '%s' rotated for '%s'\n", name, username)
+	events.closeRevoked(username)
+	sendUserToken(w, username, token)
+}
+
+// RevokeToken removes the token named in the form value 'name'
+func RevokeToken(w http.ResponseWriter, r *http.Request) {
+	username := r.Header.Get("Apiusername")
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "'name' not supplied", 400)
+		return
+	}
+	err := userDB.RevokeToken(username, name)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	log.Printf("token '%s' revoked for '%s'\n", name, username)
+	events.closeRevoked(username)
+}
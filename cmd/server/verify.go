@@ -0,0 +1,138 @@
+// store checks - storage usage and integrity of users, files and blobs
+package main
+
+import (
+	"fmt"
+	"github.com/cathalgarvey/go-minilock/taber"
+	"sort"
+	"strings"
+)
+
+// VerifyReport lists the problems verifyStores found
+type VerifyReport struct {
+	Users    int      `json:"users"`
+	Files    int      `json:"files"`
+	Blobs    int      `json:"blobs"`
+	Problems []string `json:"problems"`
+}
+
+func (report *VerifyReport) problem(format string, a ...interface{}) {
+	report.Problems = append(report.Problems, fmt.Sprintf(format, a...))
+}
+
+// fileOwner returns the user a file key belongs to
+func fileOwner(key string) string {
+	return strings.SplitN(key, "/", 2)[0]
+}
+
+// storageUsage sums up the files waiting for every user and the blobs
+// their content is kept in.
+func storageUsage() (usage AdminUsage, err error) {
+	keys, err := listFiles("")
+	if err != nil {
+		return
+	}
+	perUser := make(map[string]*AdminUserUsage)
+	for _, key := range keys {
+		meta, err := fileMeta(key)
+		if err != nil {
+			continue
+		}
+		owner := fileOwner(key)
+		u := perUser[owner]
+		if u == nil {
+			u = &AdminUserUsage{Name: owner}
+			perUser[owner] = u
+		}
+		u.Files++
+		u.Bytes += meta.Size
+		usage.Files++
+		usage.Bytes += meta.Size
+		// files of older server versions keep their content themselves
+		if !meta.Blob {
+			usage.StoredBytes += meta.Size
+		}
+	}
+	usage.Users = []AdminUserUsage{}
+	for _, u := range perUser {
+		usage.Users = append(usage.Users, *u)
+	}
+	sort.Slice(usage.Users, func(i, j int) bool { return usage.Users[i].Bytes > usage.Users[j].Bytes })
+	hashes, err := blobs.List()
+	if err != nil {
+		return
+	}
+	for _, hash := range hashes {
+		size, err := blobs.Size(hash)
+		if err != nil {
+			continue
+		}
+		usage.Blobs++
+		usage.StoredBytes += size
+	}
+	return usage, nil
+}
+
+// verifyStores checks that every user has a token and a valid public key,
+// that every file belongs to a user and has its content, and that the
+// reference count of every blob matches the files referring to it. Uploads
+// in progress while the check runs may show up as problems.
+func verifyStores() (report VerifyReport, err error) {
+	report.Problems = []string{}
+	users, err := userDB.List()
+	if err != nil {
+		return
+	}
+	known := make(map[string]bool)
+	for _, u := range users {
+		report.Users++
+		known[u.Name] = true
+		if len(u.Tokens) == 0 && u.APIToken == "" {
+			report.problem("user '%s' has no API token", u.Name)
+		}
+		if _, err := taber.FromID(u.PublicKey); err != nil {
+			report.problem("user '%s' has an invalid public key", u.Name)
+		}
+	}
+
+	keys, err := listFiles("")
+	if err != nil {
+		return
+	}
+	refs := make(map[string]int)
+	for _, key := range keys {
+		report.Files++
+		if !known[fileOwner(key)] {
+			report.problem("file '%s' belongs to no user", key)
+		}
+		meta, err := metaStore.Read(key)
+		if err == nil && meta.Blob {
+			refs[meta.Hash]++
+			if !blobs.Has(meta.Hash) {
+				report.problem("file '%s' refers to the missing blob '%s'", key, meta.Hash)
+			}
+			continue
+		}
+		// files of older server versions keep their content themselves
+		if _, err := store.Stat(key); err != nil {
+			report.problem("file '%s' has no content", key)
+		}
+	}
+
+	hashes, err := blobs.List()
+	if err != nil {
+		return
+	}
+	for _, hash := range hashes {
+		report.Blobs++
+		count, err := blobs.Refs(hash)
+		if err != nil {
+			report.problem("blob '%s' has an unreadable reference count: %s", hash, err.Error())
+			continue
+		}
+		if count != refs[hash] {
+			report.problem("blob '%s' has %d references, but %d files refer to it", hash, count, refs[hash])
+		}
+	}
+	return report, nil
+}
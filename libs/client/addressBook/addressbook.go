@@ -79,6 +79,29 @@ func (a *Addressbook) NameByAlias(alias string) (name string) {
 	return
 }
 
+// AliasByName returns the alias of the entry with the given name
+func (a *Addressbook) AliasByName(name string) (alias string) {
+	for _, entry := range a.Entries {
+		if entry.Name == name {
+			return entry.Alias
+		}
+	}
+	return
+}
+
+// AliasByPubkey returns the alias of the entry with the given public key
+func (a *Addressbook) AliasByPubkey(pubKey string) (alias string) {
+	if pubKey == "" {
+		return
+	}
+	for _, entry := range a.Entries {
+		if entry.PublicKey == pubKey {
+			return entry.Alias
+		}
+	}
+	return
+}
+
 func (a *Addressbook) AddKey(username, pubKey string) (err error) {
 	if username == "" || pubKey == "" {
 		return fmt.Errorf("'username' and 'pubKey' are required\n")
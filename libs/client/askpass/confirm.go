@@ -0,0 +1,18 @@
+package askpass
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Confirm asks the user a yes/no question and reports whether it was
+// answered with yes.
+func Confirm(question string) bool {
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Printf("%s [yes/no]: ", question)
+	answer, _ := reader.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "yes" || answer == "y"
+}
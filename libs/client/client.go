@@ -4,8 +4,11 @@ package client
 import (
 	"bufio"
 	"bytes"
+	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/cathalgarvey/go-minilock"
 	"github.com/cathalgarvey/go-minilock/taber"
@@ -20,11 +23,16 @@ import (
 	"net/http/httputil"
 	"net/textproto"
 	"net/url"
+	"os"
 	"os/user"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/scusi/secureShare/libs/client/addressBook"
+	"github.com/scusi/secureShare/libs/server/common"
 )
 
 const defaultURL = "https://securehare.scusi.io/"
@@ -32,19 +40,61 @@ const defaultURL = "https://securehare.scusi.io/"
 var Debug bool
 
 type Client struct {
-	PublicKey  string       // encodeID of the user
-	Keys       *taber.Keys  // minilock Keys
-	Salt       []byte       // salt used to scrypt the encodeID
-	Username   string       // scryped user encodeID
-	APIToken   string       // sessionID for API requests
-	URL        string       // URL of the API
-	Socksproxy string       // socks5 proxy to connect to server
-	httpClient *http.Client // http.Client to talk to the API
+	PublicKey         string            // encodeID of the user
+	Keys              *taber.Keys       // minilock Keys
+	Salt              []byte            // salt used to scrypt the encodeID
+	Username          string            // scryped user encodeID
+	APIToken          string            // sessionID for API requests
+	URL               string            // URL of the API
+	Socksproxy        string            // socks5 proxy to connect to server
+	ChunkSize         int64             // size of the chunks sent by UploadResumable
+	TTL               time.Duration     // time uploaded files are kept, server default if 0
+	ServerKey         string            // minilock ID of the server, pinned on first use
+	ServerFingerprint string            // fingerprint of the server identity, pinned on first use
+	serverSigningKey  ed25519.PublicKey // key the server signs key lookups with
+	httpClient        *http.Client      // http.Client to talk to the API
 }
 
+// maxRateRetries is the number of times Do repeats a request the server
+// answered with 429 Too Many Requests.
+const maxRateRetries = 5
+
+// maxRetryWait is the longest time Do waits before repeating a request,
+// longer Retry-After times are returned to the caller.
+const maxRetryWait = 2 * time.Minute
+
+// Do sends a request to the server. Requests answered with 429 Too Many
+// Requests are repeated after the time the server asks for in Retry-After,
+// or with an exponential backoff, as long as the request body can be sent
+// again.
 func (c *Client) Do(r *http.Request) (resp *http.Response, err error) {
-	resp, err = c.httpClient.Do(r)
-	return
+	backoff := time.Second
+	for retry := 0; ; retry++ {
+		resp, err = c.httpClient.Do(r)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || retry >= maxRateRetries {
+			return
+		}
+		if r.Body != nil && r.GetBody == nil {
+			return
+		}
+		wait := backoff
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			wait = time.Duration(seconds) * time.Second
+		}
+		if wait > maxRetryWait {
+			return resp, nil
+		}
+		resp.Body.Close()
+		if r.GetBody != nil {
+			r.Body, err = r.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+		log.Printf("server is busy, retrying in %s\n", wait)
+		time.Sleep(wait)
+		backoff *= 2
+	}
 }
 
 var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
@@ -100,6 +150,15 @@ func SetKeys(keys *taber.Keys) OptionFunc {
 	}
 }
 
+// SetServerKey pins the minilock ID of the server, API tokens are only
+// accepted if they were encrypted by this key.
+func SetServerKey(serverKey string) OptionFunc {
+	return func(client *Client) error {
+		client.ServerKey = serverKey
+		return nil
+	}
+}
+
 func SetAPIToken(token string) OptionFunc {
 	return func(client *Client) error {
 		if token == "" {
@@ -149,18 +208,26 @@ func (c *Client) SetHttpClient(hc *http.Client) {
 	c.httpClient = hc
 }
 
-// UpdateKey - asks the secureShareServer for the actual key of a given user
+// UpdateKey - asks the secureShareServer for the actual key of a given user,
+// the username is the salted hash the user shared. If the client pinned a server identity, the answer has to be signed by it.
 func (c *Client) UpdateKey(username string) (pubKey string, err error) {
+	_, err = common.VerifyUsername(username)
+	if err != nil {
+		return
+	}
 	v := url.Values{}
 	v.Add("username", username)
 	req, err := http.NewRequest("GET", c.URL+"lookupKey?"+v.Encode(), nil)
 	if err != nil {
 		return
 	}
-	resp, err := c.httpClient.Do(req)
+	req.Header.Add("APIUsername", c.Username)
+	req.Header.Add("APIKey", c.APIToken)
+	resp, err := c.Do(req)
 	if err != nil {
 		return
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
 		err = fmt.Errorf("ERROR: Server could not answer request.\n")
@@ -170,27 +237,147 @@ func (c *Client) UpdateKey(username string) (pubKey string, err error) {
 		} else {
 			log.Printf("Response:\n%s\n", dump)
 		}
-	} else {
-		pk, err := ioutil.ReadAll(resp.Body)
+		return
+	}
+	pk, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	pubKey = string(pk)
+	if c.ServerFingerprint == "" {
+		return pubKey, nil
+	}
+	// the server vouches for the key with its signature
+	if c.serverSigningKey == nil {
+		_, err = c.Identify()
 		if err != nil {
 			return "", err
 		}
-		return string(pk), err
 	}
+	signature, err := base64.StdEncoding.DecodeString(resp.Header.Get("Signature"))
+	if err != nil || !ed25519.Verify(c.serverSigningKey, common.KeyLookupMessage(username, pubKey), signature) {
+		return "", fmt.Errorf("key of '%s' is not signed by the pinned server identity", username)
+	}
+	return pubKey, nil
+}
+
+// ServerIdentity is the identity a server publishes, see Identify
+type ServerIdentity struct {
+	MinilockID  string `json:"minilockID"`
+	SigningKey  []byte `json:"signingKey"`  // ed25519 public key
+	Fingerprint string `json:"fingerprint"` // common.Fingerprint of MinilockID and SigningKey
+}
+
+// ErrNoIdentity is returned by Identify for servers without an identity
+var ErrNoIdentity = errors.New("server has no identity")
+
+// Identify fetches the identity of the server and checks it against the
+// pinned fingerprint and server key. If nothing is pinned yet, the identity
+// gets pinned.
+func (c *Client) Identify() (id *ServerIdentity, err error) {
+	req, err := http.NewRequest("GET", c.URL+".well-known/secureshare", nil)
+	if err != nil {
+		return
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 404 {
+		if c.ServerFingerprint != "" {
+			return nil, fmt.Errorf("server does not publish the pinned identity '%s'", c.ServerFingerprint)
+		}
+		return nil, ErrNoIdentity
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Response is NOT OK, Status: %s\n", resp.Status)
+	}
+	id = new(ServerIdentity)
+	err = json.NewDecoder(resp.Body).Decode(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(id.SigningKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("server identity has an invalid signing key")
+	}
+	fingerprint := common.Fingerprint(id.MinilockID, id.SigningKey)
+	if fingerprint != id.Fingerprint {
+		return nil, fmt.Errorf("server identity does not match its fingerprint")
+	}
+	if c.ServerFingerprint != "" && c.ServerFingerprint != fingerprint {
+		return nil, fmt.Errorf("server identity '%s' is not the pinned identity '%s'", fingerprint, c.ServerFingerprint)
+	}
+	if c.ServerKey != "" && c.ServerKey != id.MinilockID {
+		return nil, fmt.Errorf("server minilock ID '%s' is not the pinned key '%s'", id.MinilockID, c.ServerKey)
+	}
+	if c.ServerFingerprint == "" {
+		log.Printf("pinned server identity '%s'\n", fingerprint)
+	}
+	c.ServerFingerprint = fingerprint
+	c.ServerKey = id.MinilockID
+	c.serverSigningKey = id.SigningKey
 	return
 }
 
-// Register - register a new user at the secureShareServer
+// Register - register a new user at the secureShareServer. The server
+// sends a challenge encrypted to pubID, the client proves to own the key of
+// pubID by sending back the decrypted challenge and gets its API token.
 func (c *Client) Register(username, pubID string) (token string, err error) {
+	return c.RegisterWithInvite(username, pubID, "")
+}
+
+// RegisterWithInvite registers like Register, with an invite code for
+// servers that only accept invited users. On servers that approve new
+// accounts the token can be used once an admin approved the account.
+func (c *Client) RegisterWithInvite(username, pubID, invite string) (token string, err error) {
+	if c.Keys == nil {
+		err = fmt.Errorf("no keys to answer the registration challenge")
+		return
+	}
 	v := url.Values{}
 	v.Add("username", username)
 	v.Add("pubID", pubID)
+	if invite != "" {
+		v.Add("invite", invite)
+	}
 	// does not work
 	//req, err := http.NewRequest("POST", c.URL+"register", strings.NewReader(v.Encode()))
 	req, err := http.NewRequest("GET", c.URL+"register?"+v.Encode(), nil)
 	if err != nil {
 		return
 	}
+	_, body, err := c.registerRequest(req)
+	if err != nil {
+		return
+	}
+	_, _, nonce, err := minilock.DecryptFileContents(body, c.Keys)
+	if err != nil {
+		err = fmt.Errorf("could not decrypt registration challenge: %s", err.Error())
+		return
+	}
+	v = url.Values{}
+	v.Add("username", username)
+	v.Add("nonce", fmt.Sprintf("%x", nonce))
+	req, err = http.NewRequest("POST", c.URL+"register/confirm", strings.NewReader(v.Encode()))
+	if err != nil {
+		return
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	header, body, err := c.registerRequest(req)
+	if err != nil {
+		return
+	}
+	token, err = c.decryptToken(header.Get("Content-Type"), body)
+	if err == nil && header.Get("Account-Status") == "pending" {
+		log.Printf("your account waits for the approval of the server admin\n")
+	}
+	return
+}
+
+// registerRequest sends a request of the registration and returns the
+// header and the body of the response.
+func (c *Client) registerRequest(req *http.Request) (header http.Header, body []byte, err error) {
 	if Debug {
 		dump, _ := httputil.DumpRequestOut(req, false)
 		log.Printf("%s", dump)
@@ -203,28 +390,171 @@ func (c *Client) Register(username, pubID string) (token string, err error) {
 		dump, _ := httputil.DumpResponse(resp, true)
 		log.Printf("%s", dump)
 	}
-	body, err := ioutil.ReadAll(resp.Body)
+	defer resp.Body.Close()
+	body, err = ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return
 	}
-	// TODO: Server should encrypt token with the clients minilock key,
-	//       Client has then to decrypt the token here.
-	return fmt.Sprintf("%s", body), nil
+	if resp.StatusCode != 200 {
+		err = fmt.Errorf("registration failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+		return
+	}
+	return resp.Header, body, nil
+}
+
+// tokenContentType is the media type of a minilock encrypted API token
+const tokenContentType = "application/x-minilock"
+
+// decryptToken returns the API token from a response of the server. The
+// token has to be encrypted by the pinned server key, if no key is pinned
+// yet the key it was encrypted with gets pinned.
+func (c *Client) decryptToken(contentType string, body []byte) (token string, err error) {
+	if !strings.HasPrefix(contentType, tokenContentType) {
+		if c.ServerKey != "" {
+			err = fmt.Errorf("server sent an unencrypted token, refusing it")
+			return
+		}
+		log.Printf("WARNING: server sent the API token unencrypted\n")
+		return string(body), nil
+	}
+	if c.Keys == nil {
+		err = fmt.Errorf("no keys to decrypt the API token")
+		return
+	}
+	senderID, _, content, err := minilock.DecryptFileContents(body, c.Keys)
+	if err != nil {
+		return
+	}
+	if c.ServerKey == "" {
+		log.Printf("pinned server key '%s'\n", senderID)
+		c.ServerKey = senderID
+	} else if senderID != c.ServerKey {
+		err = fmt.Errorf("API token was encrypted by '%s', not by the pinned server key '%s'", senderID, c.ServerKey)
+		return
+	}
+	return string(content), nil
+}
+
+// ImportToken reads an API token the server admin reset the tokens of the
+// account to, and uses it from now on. The token has to be encrypted to the
+// keys of the client by the server.
+func (c *Client) ImportToken(encryptedToken []byte) (err error) {
+	token, err := c.decryptToken(tokenContentType, encryptedToken)
+	if err != nil {
+		return
+	}
+	c.APIToken = token
+	return
 }
 
 // UploadFile will upload a given file for a given user on secureShare
 func (c *Client) UploadFile(recipient string, data []byte) (fileID string, err error) {
+	log.Printf("UploadFile: length of data: %d\n", len(data))
+	return c.Upload(recipient, bytes.NewReader(data))
+}
+
+// Upload streams the (encrypted) content read from r to secureShare for the
+// given, comma separated, recipients. The request body is produced while it
+// is sent, so the content is never held in memory as a whole.
+func (c *Client) Upload(recipient string, r io.Reader) (fileID string, err error) {
 	recipientList := strings.Split(recipient, ",")
 	log.Printf("UploadFile: recipientList: %v\n", recipientList)
-	log.Printf("UploadFile: length of data: %d\n", len(data))
-	buf := bytes.NewReader(data)
-	log.Printf("UploadFile: data = %d byte\n", len(data))
+	bodyReader, bodyWriter := io.Pipe()
+	defer bodyReader.Close()
+	mimeW := multipart.NewWriter(bodyWriter)
+	fdct := mimeW.FormDataContentType()
+	go func() {
+		bodyWriter.CloseWithError(writeUploadBody(mimeW, recipientList, c.TTL, r))
+	}()
+	// build http request
+	req, err := http.NewRequest("POST", c.URL+"upload/", bodyReader)
+	if err != nil {
+		return
+	}
+	req.Header.Add("Content-Type", fdct)
+	req.Header.Add("APIUsername", c.Username)
+	req.Header.Add("APIKey", c.APIToken)
+	/*
+	 */
+	if Debug {
+		dump, err := httputil.DumpRequestOut(req, false)
+		if err != nil {
+			log.Fatal(err)
+
+		}
+		log.Printf("%s", dump)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 200 {
+		fileID, err := ioutil.ReadAll(resp.Body)
+		return string(fileID), err
+	} else {
+		dump, errDump := httputil.DumpResponse(resp, true)
+		if errDump != nil {
+			log.Printf("Could not dump response: %s\n", errDump.Error())
+		}
+		if Debug {
+			log.Printf("RESPONSE:\n%s\n", dump)
+		}
+		return "", newStatusError(resp, nil)
+	}
+}
+
+// StatusError is returned for requests the server answered with an error
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Message    string // error message sent by the server
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("Response is NOT OK, Status: %s", e.Status)
+	}
+	return fmt.Sprintf("Response is NOT OK, Status: %s: %s", e.Status, e.Message)
+}
+
+// newStatusError returns the StatusError for resp, body is read from resp
+// if it is nil.
+func newStatusError(resp *http.Response, body []byte) *StatusError {
+	if body == nil {
+		body, _ = ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	}
+	return &StatusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Message:    strings.TrimSpace(string(body)),
+	}
+}
+
+// IsQuotaError reports whether err is the answer of the server to an upload
+// that exceeds a limit, such a request must not be retried.
+func IsQuotaError(err error) bool {
+	se, ok := err.(*StatusError)
+	return ok && (se.StatusCode == http.StatusRequestEntityTooLarge ||
+		se.StatusCode == http.StatusInsufficientStorage)
+}
+
+// isTransient reports whether a request that failed with err may succeed
+// when it is retried. Network errors and answers like 503 or 429 are,
+// answers like 404 or errors writing local files are not.
+func isTransient(err error) bool {
+	if se, ok := err.(*StatusError); ok {
+		return se.StatusCode >= 500 || se.StatusCode == http.StatusTooManyRequests
+	}
+	_, local := err.(*os.PathError)
+	return !local
+}
+
+// writeUploadBody writes the multipart body of an upload request,
+// the recipientList and requested ttl followed by the file content read from r.
+func writeUploadBody(mimeW *multipart.Writer, recipientList []string, ttl time.Duration, r io.Reader) (err error) {
 	fieldname := "file"
 	filename := "data.file"
-	//bodyReader, bodyWriter := io.Pipe()
-	var body bytes.Buffer
-	bodyWriter := bufio.NewWriter(&body)
-	mimeW := multipart.NewWriter(bodyWriter)
 	// WIP create a recipientList
 	rh := make(textproto.MIMEHeader)
 	rh.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"`, escapeQuotes("recipientList")))
@@ -236,8 +566,13 @@ func (c *Client) UploadFile(recipient string, data []byte) (fileID string, err e
 	for _, recipient := range recipientList {
 		part.Write([]byte(recipient + "\n"))
 	}
+	if ttl > 0 {
+		err = mimeW.WriteField("ttl", ttl.String())
+		if err != nil {
+			return
+		}
+	}
 
-	fdct := mimeW.FormDataContentType()
 	fh := make(textproto.MIMEHeader)
 	fh.Set("Content-Disposition",
 		fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
@@ -249,55 +584,270 @@ func (c *Client) UploadFile(recipient string, data []byte) (fileID string, err e
 		return
 	}
 	log.Printf("new part created")
-	//n, err := part.Write(data)
-	n, err := io.Copy(part, buf)
+	n, err := io.Copy(part, r)
 	if err != nil {
 		return
 	}
 	log.Printf("%d byte written to mime part\n", n)
-	mimeW.Close()
-	bodyWriter.Flush()
-	bodyReader := bufio.NewReader(&body)
-	// build http request
-	req, err := http.NewRequest("POST", c.URL+"upload/", bodyReader)
+	return mimeW.Close()
+}
+
+// DefaultChunkSize is the amount of data UploadResumable sends per request
+// if the Client has no ChunkSize configured.
+const DefaultChunkSize = 4 << 20
+
+// maxRetries is the number of times a failed chunk is retried before
+// UploadResumable gives up.
+const maxRetries = 10
+
+// UploadResumable uploads the (encrypted) content read from r in chunks via
+// an upload session. If a chunk fails, e.g. because the connection dropped,
+// the upload resumes from the last offset acknowledged by the server.
+// Servers without upload sessions get the content via a regular Upload.
+func (c *Client) UploadResumable(recipient string, r io.ReadSeeker) (fileID string, err error) {
+	sessionID, err := c.CreateUploadSession(recipient)
+	if err == errNoSessions {
+		log.Printf("server does not support upload sessions, uploading in one piece\n")
+		return c.Upload(recipient, r)
+	}
 	if err != nil {
 		return
 	}
-	req.Header.Add("Content-Type", fdct)
+	return c.ResumeUpload(sessionID, r)
+}
+
+var errNoSessions = fmt.Errorf("upload sessions are not supported by the server")
+
+// CreateUploadSession starts an upload session for the given, comma
+// separated, recipients and returns its ID.
+func (c *Client) CreateUploadSession(recipient string) (sessionID string, err error) {
+	v := url.Values{}
+	v.Add("recipientList", strings.Join(strings.Split(recipient, ","), "\n"))
+	if c.TTL > 0 {
+		v.Add("ttl", c.TTL.String())
+	}
+	body, err := c.apiRequest("POST", "upload/session", strings.NewReader(v.Encode()))
+	if err != nil {
+		return
+	}
+	return string(body), nil
+}
+
+// ResumeUpload sends the content of r to an existing upload session,
+// starting at the offset the server has acknowledged, and commits the
+// session once all data is transferred.
+func (c *Client) ResumeUpload(sessionID string, r io.ReadSeeker) (fileID string, err error) {
+	chunkSize := c.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	chunk := make([]byte, chunkSize)
+	retries := 0
+	for {
+		var offset int64
+		offset, err = c.uploadOffset(sessionID)
+		if err == nil {
+			_, err = r.Seek(offset, io.SeekStart)
+		}
+		var n int
+		if err == nil {
+			n, err = io.ReadFull(r, chunk)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = nil
+			}
+		}
+		if err == nil && n == 0 {
+			break
+		}
+		if err == nil {
+			_, err = c.apiRequest("PUT",
+				fmt.Sprintf("upload/session/%s/%d", sessionID, offset),
+				bytes.NewReader(chunk[:n]))
+			if err == nil {
+				retries = 0
+				log.Printf("upload session '%s': %d byte sent\n", sessionID, offset+int64(n))
+				continue
+			}
+		}
+		retries++
+		if retries > maxRetries || IsQuotaError(err) {
+			return
+		}
+		log.Printf("upload session '%s' interrupted, retrying: %s\n", sessionID, err.Error())
+		time.Sleep(time.Duration(retries) * time.Second)
+	}
+	body, err := c.apiRequest("POST", "upload/session/"+sessionID+"/commit", nil)
+	if err != nil {
+		return
+	}
+	return string(body), nil
+}
+
+// uploadOffset asks the server where the next chunk of a session starts
+func (c *Client) uploadOffset(sessionID string) (offset int64, err error) {
+	body, err := c.apiRequest("GET", "upload/session/"+sessionID, nil)
+	if err != nil {
+		return
+	}
+	return strconv.ParseInt(string(body), 10, 64)
+}
+
+// apiRequest sends an authenticated request to the API and returns the body
+// of the response.
+func (c *Client) apiRequest(method, path string, body io.Reader) (respBody []byte, err error) {
+	_, respBody, err = c.apiRequestHeader(method, path, body)
+	return
+}
+
+// apiRequestHeader is apiRequest, it also returns the header of the response
+func (c *Client) apiRequestHeader(method, path string, body io.Reader) (header http.Header, respBody []byte, err error) {
+	req, err := http.NewRequest(method, c.URL+path, body)
+	if err != nil {
+		return
+	}
+	if method == "POST" && body != nil {
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	}
 	req.Header.Add("APIUsername", c.Username)
 	req.Header.Add("APIKey", c.APIToken)
-	/*
-	 */
 	if Debug {
-		dump, err := httputil.DumpRequestOut(req, false)
-		if err != nil {
-			log.Fatal(err)
-
+		dump, errDump := httputil.DumpRequestOut(req, false)
+		if errDump != nil {
+			log.Printf("Could not dump request '%s'\n", errDump.Error())
 		}
-		log.Printf("%s", dump)
+		log.Printf("RequestDump:\n%s\n", dump)
 	}
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.Do(req)
 	if err != nil {
-		return "", err
+		return
 	}
-	if resp.StatusCode == 200 {
-		fileID, err := ioutil.ReadAll(resp.Body)
-		return string(fileID), err
-	} else {
-		err := fmt.Errorf("Request could not be processed by the server\n")
-		dump, errDump := httputil.DumpResponse(resp, true)
-		if errDump != nil {
-			log.Printf("Could not dump response: %s\n", errDump.Error())
+	defer resp.Body.Close()
+	respBody, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if path == "upload/session" && (resp.StatusCode == 404 || resp.StatusCode == 405) {
+		return nil, nil, errNoSessions
+	}
+	if resp.StatusCode != 200 {
+		if Debug {
+			log.Printf("ResponseBody:\n%s\n", respBody)
 		}
-		log.Printf("RESPONSE:\n%s\n", dump)
-		return "", err
+		return nil, nil, newStatusError(resp, respBody)
 	}
+	return resp.Header, respBody, nil
 }
 
-func (c *Client) List() (fileList string, err error) {
+// DeleteAccount deletes the account of the user on the server, files
+// waiting for the user are deleted as well.
+func (c *Client) DeleteAccount() (err error) {
+	_, err = c.apiRequest("DELETE", "account", nil)
+	return
+}
+
+// Usage tells how much of the limits of the server the user used, limits
+// of 0 mean there is no limit.
+type Usage struct {
+	Files            int   `json:"files"` // files waiting for the user
+	Bytes            int64 `json:"bytes"`
+	InboxMaxFiles    int   `json:"inboxMaxFiles"`
+	InboxQuota       int64 `json:"inboxQuota"`
+	SentToday        int64 `json:"sentToday"` // byte uploaded by the user today (UTC)
+	DailyUploadLimit int64 `json:"dailyUploadLimit"`
+	MaxUploadSize    int64 `json:"maxUploadSize"`
+}
+
+// Usage returns the storage used by the user and the limits of the server
+func (c *Client) Usage() (usage *Usage, err error) {
+	body, err := c.apiRequest("GET", "usage", nil)
+	if err != nil {
+		return
+	}
+	usage = new(Usage)
+	err = json.Unmarshal(body, usage)
+	return
+}
+
+// TokenInfo describes an API token of the user
+type TokenInfo struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Current bool      `json:"current"` // token used by this client
+}
+
+// ListTokens returns the API tokens of the user
+func (c *Client) ListTokens() (tokens []TokenInfo, err error) {
+	body, err := c.apiRequest("GET", "token/list", nil)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &tokens)
+	return
+}
+
+// CreateToken issues a new API token with the given name, e.g. for another
+// device of the user.
+func (c *Client) CreateToken(name string) (token string, err error) {
+	v := url.Values{}
+	v.Add("name", name)
+	header, body, err := c.apiRequestHeader("POST", "token/create", strings.NewReader(v.Encode()))
+	if err != nil {
+		return
+	}
+	return c.decryptToken(header.Get("Content-Type"), body)
+}
+
+// RotateToken replaces the API token with the given name by a new one. An
+// empty name rotates the token of the client, which is updated in place.
+func (c *Client) RotateToken(name string) (token string, err error) {
+	v := url.Values{}
+	v.Add("name", name)
+	header, body, err := c.apiRequestHeader("POST", "token/rotate", strings.NewReader(v.Encode()))
+	if err != nil {
+		return
+	}
+	token, err = c.decryptToken(header.Get("Content-Type"), body)
+	if err != nil {
+		return
+	}
+	if name == "" {
+		c.APIToken = token
+	}
+	return
+}
+
+// RevokeToken removes the API token with the given name
+func (c *Client) RevokeToken(name string) (err error) {
+	v := url.Values{}
+	v.Add("name", name)
+	_, err = c.apiRequest("POST", "token/revoke", strings.NewReader(v.Encode()))
+	return
+}
+
+// FileInfo describes a file waiting on the server
+type FileInfo struct {
+	FileID     string    `json:"fileID"`
+	Size       int64     `json:"size"`
+	UploadedAt time.Time `json:"uploadedAt"`
+	ExpiresAt  time.Time `json:"expiresAt"` // zero if the file does not expire
+	Sender     string    `json:"sender"`    // username of the sender, empty if unknown
+}
+
+// fileList is the JSON file list sent by the server
+type fileList struct {
+	Version int        `json:"version"`
+	Files   []FileInfo `json:"files"`
+}
+
+// List returns the files waiting for the user on the server
+func (c *Client) List() (files []FileInfo, err error) {
 	req, err := http.NewRequest("GET", c.URL+"list/", nil)
+	if err != nil {
+		return
+	}
 	req.Header.Add("APIUsername", c.Username)
 	req.Header.Add("APIKey", c.APIToken)
+	req.Header.Add("Accept", "application/vnd.secureshare.list.v1+json, application/json")
 	if Debug {
 		dump, errDump := httputil.DumpRequestOut(req, true)
 		if errDump != nil {
@@ -309,6 +859,7 @@ func (c *Client) List() (fileList string, err error) {
 	if err != nil {
 		return
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		err = fmt.Errorf("Response is NOT OK, Status: %s\n", resp.Status)
 		dump, errDump := httputil.DumpResponse(resp, true)
@@ -318,17 +869,143 @@ func (c *Client) List() (fileList string, err error) {
 		log.Printf("ResponseDump:\n%s\n", dump)
 		return
 	}
-	list, err := ioutil.ReadAll(resp.Body)
+	if !strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		// older servers only know the text list
+		return parseTextList(resp.Body)
+	}
+	var list fileList
+	err = json.NewDecoder(resp.Body).Decode(&list)
 	if err != nil {
 		return
 	}
-	return string(list), nil
+	if list.Version != 1 {
+		return nil, fmt.Errorf("unsupported file list version %d", list.Version)
+	}
+	return list.Files, nil
+}
+
+// parseTextList reads fileIDs and sizes from a text file list,
+// lines look like: 'fileID'  size, time
+func parseTextList(r io.Reader) (files []FileInfo, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		size, _ := strconv.ParseInt(strings.TrimSuffix(fields[1], ","), 10, 64)
+		files = append(files, FileInfo{
+			FileID: strings.Trim(fields[0], "'"),
+			Size:   size,
+		})
+	}
+	return files, scanner.Err()
+}
+
+// legacyFileID matches the fileIDs of older servers, a hex encoded
+// common.ShortID of the file content.
+var legacyFileID = regexp.MustCompile("^[0-9a-f]{8}$")
+
+// CheckFileID returns an error if fileID is not a valid fileID, so typos
+// are caught before the server is asked for the file.
+func CheckFileID(fileID string) (err error) {
+	if legacyFileID.MatchString(fileID) {
+		return nil
+	}
+	_, err = common.VerifyFileID(fileID)
+	if err != nil {
+		return fmt.Errorf("invalid fileID '%s': %s", fileID, err.Error())
+	}
+	return
 }
 
+// DownloadFile downloads, decrypts and acknowledges the file with the given
+// fileID. The encrypted file is downloaded into a '.part' file within the
+// client config directory first, an interrupted download continues where it
+// stopped. The server erases the file only after it has been decrypted.
 func (c *Client) DownloadFile(fileID string) (filename string, fileContent []byte, err error) {
+	f, err := c.Receive(fileID)
+	if err != nil {
+		return
+	}
+	err = c.Acknowledge(fileID)
+	if err != nil {
+		return
+	}
+	return f.Filename, f.Content, nil
+}
+
+// ReceivedFile is a file downloaded and decrypted by Receive
+type ReceivedFile struct {
+	FileID   string
+	Filename string // name the sender gave the file, may contain a path
+	Content  []byte
+	SenderID string // minilock ID of the sender, as proven by the encryption
+}
+
+// Receive downloads and decrypts the file with the given fileID like
+// DownloadFile, but leaves it on the server. The caller can check the
+// sender before it calls Acknowledge.
+func (c *Client) Receive(fileID string) (f *ReceivedFile, err error) {
+	err = CheckFileID(fileID)
+	if err != nil {
+		return
+	}
+	partPath, err := c.partFilePath(fileID)
+	if err != nil {
+		return
+	}
+	retries := 0
+	for {
+		err = c.downloadPart(fileID, partPath)
+		if err == nil {
+			break
+		}
+		retries++
+		if retries > maxRetries || !isTransient(err) {
+			return
+		}
+		log.Printf("download of '%s' interrupted, retrying: %s\n", fileID, err.Error())
+		time.Sleep(time.Duration(retries) * time.Second)
+	}
+	fileContent, err := ioutil.ReadFile(partPath)
+	if err != nil {
+		return
+	}
+	senderId, filename, content, err := minilock.DecryptFileContents(fileContent, c.Keys)
+	if err != nil {
+		log.Printf("decryption error: '%s'\n", err.Error())
+		return
+	}
+	log.Printf("SenderID was: %s\n", senderId)
+	os.Remove(partPath)
+	return &ReceivedFile{FileID: fileID, Filename: filename, Content: content, SenderID: senderId}, nil
+}
+
+// downloadPart fetches the (remaining) content of a file into partPath,
+// using a Range request if parts of the file have been received before.
+func (c *Client) downloadPart(fileID, partPath string) (err error) {
+	f, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+	offset := fi.Size()
 	req, err := http.NewRequest("GET", c.URL+c.Username+"/"+fileID, nil)
+	if err != nil {
+		return
+	}
 	req.Header.Add("APIUsername", c.Username)
 	req.Header.Add("APIKey", c.APIToken)
+	if offset > 0 {
+		// the server sends the whole file if it is not the one we started with
+		req.Header.Add("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Add("If-Range", "\""+fileID+"\"")
+	}
 	if Debug {
 		dump, errDump := httputil.DumpRequestOut(req, true)
 		if errDump != nil {
@@ -340,25 +1017,88 @@ func (c *Client) DownloadFile(fileID string) (filename string, fileContent []byt
 	if err != nil {
 		return
 	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		offset = 0
+	case http.StatusPartialContent:
+		log.Printf("resuming download of '%s' at %d byte\n", fileID, offset)
+	case http.StatusRequestedRangeNotSatisfiable:
+		// everything has been received already
+		return nil
+	default:
+		return newStatusError(resp, nil)
+	}
+	err = f.Truncate(offset)
+	if err != nil {
+		return
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(f, resp.Body)
+	return
+}
+
+// Acknowledge tells the server that a file has been received and decrypted,
+// the server erases it afterwards.
+func (c *Client) Acknowledge(fileID string) (err error) {
+	req, err := http.NewRequest("DELETE", c.URL+c.Username+"/"+fileID, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Add("APIUsername", c.Username)
+	req.Header.Add("APIKey", c.APIToken)
+	resp, err := c.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		err = fmt.Errorf("Response is NOT OK, Status: %s\n", resp.Status)
-		dump, errDump := httputil.DumpResponse(resp, true)
-		if errDump != nil {
-			log.Printf("Could not dump response '%s'\n", errDump.Error())
-		}
-		log.Printf("ResponseDump:\n%s\n", dump)
 		return
 	}
-	fileContent, err = ioutil.ReadAll(resp.Body)
+	return
+}
+
+// configDir returns the directory the client configuration is stored in
+func (c *Client) configDir() (dir string, err error) {
+	usr, err := user.Current()
+	if err != nil {
+		return
+	}
+	return filepath.Join(usr.HomeDir, ".config", "secureshare", "client", c.Username), nil
+}
+
+// partFilePath returns the path incomplete downloads of fileID are kept at
+func (c *Client) partFilePath(fileID string) (partPath string, err error) {
+	dir, err := c.configDir()
 	if err != nil {
 		return
 	}
-	senderId, filename, content, err := minilock.DecryptFileContents(fileContent, c.Keys)
+	dir = filepath.Join(dir, "downloads")
+	err = os.MkdirAll(dir, 0700)
 	if err != nil {
-		log.Printf("decryption error: '%s'\n", err.Error())
+		return
 	}
-	log.Printf("SenderID was: %s\n", senderId)
-	return filename, content, err
+	return filepath.Join(dir, filepath.Base(fileID)+".part"), nil
+}
+
+// LoadAddressbook reads the addressbook of the user
+func (c *Client) LoadAddressbook() (a *addressbook.Addressbook, err error) {
+	usr, err := user.Current()
+	if err != nil {
+		return
+	}
+	addressbookPath := filepath.Join(usr.HomeDir, ".config", "secureshare", "client", c.Username)
+	addressbookPath = filepath.Join(addressbookPath, "addressbook.yml")
+	adata, err := ioutil.ReadFile(addressbookPath)
+	if err != nil {
+		return
+	}
+	err = yaml.Unmarshal(adata, &a)
+	return
 }
 
 func (c *Client) SaveAddressbook(a *addressbook.Addressbook) (err error) {
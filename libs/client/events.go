@@ -0,0 +1,210 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// event types
+const (
+	EventNewFile = "new"     // a file arrived for the user
+	EventExpired = "expired" // a file was removed by the server because it expired
+)
+
+// maxWatchBackoff is the longest time Watch waits before it reconnects
+const maxWatchBackoff = 5 * time.Minute
+
+// Event tells about a change of the inbox of the user
+type Event struct {
+	Type   string    `json:"type"`
+	FileID string    `json:"fileID"`
+	Size   int64     `json:"size,omitempty"`
+	Sender string    `json:"sender,omitempty"` // username of the sender, empty if unknown
+	Time   time.Time `json:"time"`
+}
+
+// Watch returns the events of the inbox of the user as the server sends
+// them, until ctx is done and the channel is closed. Files waiting already
+// are not reported. If the connection to the server breaks Watch reconnects,
+// files that arrived in the meantime are reported as new files then. The
+// channel is closed as well once the token of the client is not accepted
+// anymore.
+func (c *Client) Watch(ctx context.Context) (events <-chan Event, err error) {
+	body, err := c.openEvents(ctx)
+	if err != nil {
+		return
+	}
+	known, err := c.knownFiles()
+	if err != nil {
+		body.Close()
+		return
+	}
+	ch := make(chan Event)
+	go c.watch(ctx, body, known, ch)
+	return ch, nil
+}
+
+// watch reads events from body and reconnects until ctx is done
+func (c *Client) watch(ctx context.Context, body io.ReadCloser, known map[string]bool, ch chan<- Event) {
+	defer close(ch)
+	backoff := time.Second
+	for {
+		if body != nil {
+			err := c.readEvents(ctx, body, known, ch)
+			body.Close()
+			body = nil
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("event stream closed, reconnecting: %v\n", err)
+			backoff = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		var err error
+		body, err = c.openEvents(ctx)
+		if err == nil {
+			err = c.catchUp(ctx, known, ch)
+		}
+		if err != nil {
+			if body != nil {
+				body.Close()
+				body = nil
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			// the token was revoked or the account deleted
+			if se, ok := err.(*StatusError); ok && se.StatusCode == http.StatusUnauthorized {
+				log.Printf("event stream closed by the server: %s\n", err.Error())
+				return
+			}
+			log.Printf("could not reconnect to event stream: %s\n", err.Error())
+			backoff *= 2
+			if backoff > maxWatchBackoff {
+				backoff = maxWatchBackoff
+			}
+		}
+	}
+}
+
+// openEvents connects to the event stream of the server
+func (c *Client) openEvents(ctx context.Context) (body io.ReadCloser, err error) {
+	req, err := http.NewRequest("GET", c.URL+"events", nil)
+	if err != nil {
+		return
+	}
+	req = req.WithContext(ctx)
+	req.Header.Add("APIUsername", c.Username)
+	req.Header.Add("APIKey", c.APIToken)
+	req.Header.Add("Accept", "text/event-stream")
+	resp, err := c.Do(req)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != 200 {
+		defer resp.Body.Close()
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, newStatusError(resp, respBody)
+	}
+	return resp.Body, nil
+}
+
+// knownFiles returns the fileIDs of the files waiting for the user
+func (c *Client) knownFiles() (known map[string]bool, err error) {
+	files, err := c.List()
+	if err != nil {
+		return
+	}
+	known = make(map[string]bool)
+	for _, fi := range files {
+		known[fi.FileID] = true
+	}
+	return
+}
+
+// catchUp reports the files that arrived while the event stream was broken
+func (c *Client) catchUp(ctx context.Context, known map[string]bool, ch chan<- Event) (err error) {
+	files, err := c.List()
+	if err != nil {
+		return
+	}
+	waiting := make(map[string]bool)
+	for _, fi := range files {
+		waiting[fi.FileID] = true
+		if known[fi.FileID] {
+			continue
+		}
+		known[fi.FileID] = true
+		e := Event{Type: EventNewFile, FileID: fi.FileID, Size: fi.Size, Sender: fi.Sender, Time: fi.UploadedAt}
+		select {
+		case ch <- e:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	// forget the files that are gone, downloaded or expired
+	for fileID := range known {
+		if !waiting[fileID] {
+			delete(known, fileID)
+		}
+	}
+	return nil
+}
+
+// readEvents parses Server-Sent Events from r and sends them to ch. Events
+// for new files that are known already are skipped.
+func (c *Client) readEvents(ctx context.Context, r io.Reader, known map[string]bool, ch chan<- Event) (err error) {
+	scanner := bufio.NewScanner(r)
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+			continue
+		case line != "":
+			// comments, event names and fields we do not use
+			continue
+		}
+		if len(data) == 0 {
+			continue
+		}
+		var e Event
+		err = json.Unmarshal([]byte(strings.Join(data, "\n")), &e)
+		data = nil
+		if err != nil {
+			log.Printf("invalid event: %s\n", err.Error())
+			continue
+		}
+		switch e.Type {
+		case EventNewFile:
+			if known[e.FileID] {
+				continue
+			}
+			known[e.FileID] = true
+		case EventExpired:
+			delete(known, e.FileID)
+		}
+		select {
+		case ch <- e:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	err = scanner.Err()
+	if err == nil {
+		err = io.EOF
+	}
+	return
+}
@@ -3,23 +3,31 @@ package common
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/base64"
 	"fmt"
 	"github.com/dchest/blake2b"
 	"github.com/dchest/blake2s"
 	"github.com/decred/base58"
+	"hash"
 )
 
 // LongID - genertes a blake2b 32 byte checksum over given data.
 func LongID(data []byte) (id string) {
-	b := blake2b.New256()
+	b := NewLongIDHash()
 	b.Write(data)
 	bsum := b.Sum(nil)
 	return fmt.Sprintf("%x", bsum)
 }
 
+// NewLongIDHash - returns the hash used by LongID, for data that is streamed
+// rather than held in memory.
+func NewLongIDHash() hash.Hash {
+	return blake2b.New256()
+}
+
 // generate a short file ID based on blake2s
 func ShortID(data []byte) (c string, err error) {
-	hash, err := blake2s.New(&blake2s.Config{Size: 4, Person: []byte("scusi.v1")})
+	hash, err := NewShortIDHash()
 	if err != nil {
 		return
 	}
@@ -31,6 +39,12 @@ func ShortID(data []byte) (c string, err error) {
 	return
 }
 
+// NewShortIDHash - returns the hash used by ShortID, for data that is
+// streamed rather than held in memory.
+func NewShortIDHash() (hash.Hash, error) {
+	return blake2s.New(&blake2s.Config{Size: 4, Person: []byte("scusi.v1")})
+}
+
 // NewUserID - generates a new (random) userID, which is integrity protected
 // by a 1 byte blake2s checksum
 func NewUserID() (encodedUID string, err error) {
@@ -65,6 +79,63 @@ func VerifyUserID(encodedUID string) (ok bool, err error) {
 	}
 }
 
+// fileIDSize is the number of random bytes in a fileID
+const fileIDSize = 10
+
+// fileIDChecksumSize is the number of checksum bytes appended to a fileID
+const fileIDChecksumSize = 2
+
+// NewFileID - generates a new random fileID, which is integrity protected
+// by a 2 byte blake2s checksum, so typos are detected by VerifyFileID.
+// The fileID is base58 encoded to be easily typed by humans.
+func NewFileID() (encodedID string, err error) {
+	id := make([]byte, fileIDSize)
+	_, err = rand.Read(id)
+	if err != nil {
+		return
+	}
+	cs, err := fileIDChecksum(id)
+	if err != nil {
+		return
+	}
+	encodedID = base58.Encode(append(id, cs...))
+	return
+}
+
+// VerifyFileID - checks if a fileID is syntactical valid
+func VerifyFileID(encodedID string) (ok bool, err error) {
+	decodedID := base58.Decode(encodedID)
+	if len(decodedID) != fileIDSize+fileIDChecksumSize {
+		err = fmt.Errorf("fileID has an invalid length or characters")
+		return
+	}
+	id := decodedID[:fileIDSize]
+	cs := decodedID[fileIDSize:]
+	myCs, err := fileIDChecksum(id)
+	if err != nil {
+		return
+	}
+	if !bytes.Equal(myCs, cs) {
+		err = fmt.Errorf("fileID checksum check failed, check for typos")
+		return
+	}
+	return true, nil
+}
+
+// fileIDChecksum - generates the checksum of a fileID
+func fileIDChecksum(id []byte) (cs []byte, err error) {
+	checksum, err := blake2s.New(&blake2s.Config{Size: fileIDChecksumSize, Person: []byte("ssFCheck")})
+	if err != nil {
+		return
+	}
+	_, err = checksum.Write(id)
+	if err != nil {
+		return
+	}
+	cs = checksum.Sum(nil)
+	return
+}
+
 // shortChecksum - generates a short blake2s checksum
 func shortChecksum(data []byte, size uint8) (cs []byte, err error) {
 	checksum, err := blake2s.New(&blake2s.Config{Size: size, Person: []byte("ssUCheck")})
@@ -79,3 +150,38 @@ func shortChecksum(data []byte, size uint8) (cs []byte, err error) {
 	return
 
 }
+
+// Fingerprint - returns the fingerprint of a server identity, consisting of
+// the minilock ID and the ed25519 signing key of the server. Clients pin it
+// to recognize the server.
+func Fingerprint(minilockID string, signingKey []byte) (fingerprint string) {
+	b := NewLongIDHash()
+	b.Write([]byte(minilockID))
+	b.Write([]byte{0})
+	b.Write(signingKey)
+	return fmt.Sprintf("%x", b.Sum(nil)[:20])
+}
+
+// KeyLookupMessage - returns the message the server signs to vouch that
+// publicKey is the key of username.
+func KeyLookupMessage(username, publicKey string) (message []byte) {
+	return []byte("secureShare lookupKey\n" + username + "\n" + publicKey)
+}
+
+// usernameSize is the size of the salted hash a username is made of
+const usernameSize = 32
+
+// VerifyUsername - checks that username is a base64url encoded 32 byte
+// salted hash, like clients derive it from their encodeID with scrypt.
+func VerifyUsername(username string) (ok bool, err error) {
+	hash, err := base64.URLEncoding.DecodeString(username)
+	if err != nil {
+		err = fmt.Errorf("username is not base64url encoded")
+		return
+	}
+	if len(hash) != usernameSize {
+		err = fmt.Errorf("username has %d byte, not %d", len(hash), usernameSize)
+		return
+	}
+	return true, nil
+}
@@ -5,16 +5,54 @@ import (
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"log"
+	"time"
 )
 
+// RateLimit is the number of requests a client can make to a route, it is
+// applied per client IP and per authenticated user.
+type RateLimit struct {
+	PerMinute int // requests per minute on average, 0 means no limit
+	Burst     int // requests that can be made at once
+}
+
 type Config struct {
 	ListenAddr string // host:port listen address
 	CertFile   string // TLS certificate to use
 	KeyFile    string // TLS key to use
 	DataDir    string // directory where userdata is written to
-	UsersFile  string // yaml file which holds the user database
+	Storage    string // storage backend for uploaded files: "diskv", "filesystem" or "s3"
+	UsersFile  string // file which holds the user database
+	UserStore  string // format of the UsersFile: "yaml" or "bolt"
 	Email      string // Email to be used for the server minilock identity
 	Password   string // Password to be used for the server minilock identity
+
+	RegistrationMode string // who can register: "open", "invite" (with an invite code) or "approval" (by an admin)
+	InvitesFile      string // yaml file which holds the unused invite codes
+	AdminListenAddr  string // host:port the admin API listens on
+	AdminToken       string // token the admin API is authenticated with, the admin API is off if empty
+
+	MaxUploadSize    int64 // largest file in byte a user can upload, 0 means no limit
+	InboxQuota       int64 // byte of files that can wait for a user, 0 means no limit
+	InboxMaxFiles    int   // number of files that can wait for a user, 0 means no limit
+	DailyUploadLimit int64 // byte a user can upload per day, 0 means no limit
+
+	RateLimits   map[string]RateLimit // limits by route: "register", "lookup", "upload", "session", "download" and "api"
+	AuthFailures int                  // failed authentications after which a client IP is locked out, 0 means no lockout
+	LockoutTime  time.Duration        // time a client IP is locked out
+	// Without RealIPHeader clients of a Tor onion service or a proxy all
+	// come from a loopback address, limits per client IP are then only
+	// applied to unauthenticated routes and they are not locked out.
+	RealIPHeader string // header a reverse proxy puts the client IP in, e.g. "X-Forwarded-For"
+
+	DefaultTTL    time.Duration // time files are kept if the sender did not ask otherwise, 0 keeps them forever
+	MaxTTL        time.Duration // upper limit for the time a sender can ask a file to be kept, 0 means no limit
+	SweepInterval time.Duration // interval in which expired files are removed
+
+	S3Endpoint  string // URL of the S3 compatible service, used with storage "s3"
+	S3Region    string // region of the S3 bucket
+	S3Bucket    string // name of the S3 bucket files are stored in
+	S3AccessKey string // access key ID for the S3 service
+	S3SecretKey string // secret access key for the S3 service
 }
 
 func New() (cfg *Config) {
@@ -23,9 +61,38 @@ func New() (cfg *Config) {
 		CertFile:   "",
 		KeyFile:    "",
 		DataDir:    "data",
+		Storage:    "diskv",
 		UsersFile:  "users.yml",
+		UserStore:  "yaml",
 		Email:      "",
 		Password:   "",
+
+		RegistrationMode: "open",
+		InvitesFile:      "invites.yml",
+		AdminListenAddr:  "127.0.0.1:9998",
+		AdminToken:       "",
+
+		MaxUploadSize:    0,
+		InboxQuota:       10 << 30,
+		InboxMaxFiles:    1000,
+		DailyUploadLimit: 20 << 30,
+
+		RateLimits: map[string]RateLimit{
+			"register": {PerMinute: 10, Burst: 5},
+			"lookup":   {PerMinute: 60, Burst: 20},
+			"upload":   {PerMinute: 60, Burst: 20},
+			"session":  {PerMinute: 600, Burst: 100},
+			"download": {PerMinute: 120, Burst: 30},
+			"api":      {PerMinute: 120, Burst: 30},
+		},
+		AuthFailures: 10,
+		LockoutTime:  15 * time.Minute,
+
+		DefaultTTL:    72 * time.Hour,
+		MaxTTL:        7 * 24 * time.Hour,
+		SweepInterval: 10 * time.Minute,
+
+		S3Region: "us-east-1",
 	}
 	return
 }
@@ -36,7 +103,8 @@ func ReadFromFile(filename string) (cfg *Config, err error) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	cfg = new(Config)
+	// start with the defaults, so options missing in the file keep them
+	cfg = New()
 	err = yaml.Unmarshal(cdata, cfg)
 	if err != nil {
 		return
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// blobDir is the directory blobs are stored in, it can not collide with
+// usernames, which never start with a dot.
+const blobDir = ".blobs"
+
+// refsSuffix is appended to the key of a blob to get the key its reference
+// count is stored under.
+const refsSuffix = ".refs"
+
+// Blobs keeps the content of uploaded files exactly once, under the
+// common.LongID of the content, no matter how many recipients a file has.
+// Recipients hold references to a blob, it is removed along with the last
+// reference.
+type Blobs struct {
+	store Storage
+	mu    sync.Mutex
+}
+
+// NewBlobs returns Blobs kept in the given store
+func NewBlobs(store Storage) (b *Blobs) {
+	return &Blobs{store: store}
+}
+
+// BlobKey returns the key the blob with the given hash is stored under
+func BlobKey(hash string) string {
+	return blobDir + "/" + hash
+}
+
+// IsBlobKey reports whether key belongs to a blob or its reference count
+func IsBlobKey(key string) bool {
+	return strings.HasPrefix(key, blobDir+"/")
+}
+
+// Add stores the local file at path as the blob with the given hash, unless
+// the blob exists already, and adds refs references to it.
+func (b *Blobs) Add(path, hash string, refs int) (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	count, err := b.refs(hash)
+	if err != nil {
+		return
+	}
+	if count == 0 {
+		err = StoreFile(b.store, path, BlobKey(hash))
+		if err != nil {
+			return
+		}
+	}
+	return b.setRefs(hash, count+refs)
+}
+
+// Open opens the blob with the given hash for reading
+func (b *Blobs) Open(hash string) (o Object, info *Info, err error) {
+	info, err = b.store.Stat(BlobKey(hash))
+	if err != nil {
+		return
+	}
+	o, err = b.store.Get(BlobKey(hash))
+	return
+}
+
+// Has reports whether a blob with the given hash is stored
+func (b *Blobs) Has(hash string) bool {
+	if hash == "" {
+		return false
+	}
+	_, err := b.store.Stat(BlobKey(hash))
+	return err == nil
+}
+
+// Release drops a reference to the blob with the given hash. The blob is
+// removed when there are no references left.
+func (b *Blobs) Release(hash string) (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	count, err := b.refs(hash)
+	if err != nil {
+		return
+	}
+	if count > 1 {
+		return b.setRefs(hash, count-1)
+	}
+	err = b.store.Delete(BlobKey(hash))
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	err = b.store.Delete(BlobKey(hash) + refsSuffix)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return
+}
+
+// List returns the hashes of all stored blobs
+func (b *Blobs) List() (hashes []string, err error) {
+	keys, err := b.store.List(blobDir + "/")
+	if err != nil {
+		return
+	}
+	for _, k := range keys {
+		if strings.HasSuffix(k, refsSuffix) {
+			continue
+		}
+		hashes = append(hashes, strings.TrimPrefix(k, blobDir+"/"))
+	}
+	return
+}
+
+// Size returns the size of the blob with the given hash
+func (b *Blobs) Size(hash string) (size int64, err error) {
+	info, err := b.store.Stat(BlobKey(hash))
+	if err != nil {
+		return
+	}
+	return info.Size, nil
+}
+
+// Refs returns the number of references to the blob with the given hash
+func (b *Blobs) Refs(hash string) (count int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.refs(hash)
+}
+
+func (b *Blobs) refs(hash string) (count int, err error) {
+	o, err := b.store.Get(BlobKey(hash) + refsSuffix)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return
+	}
+	defer o.Close()
+	data, err := ioutil.ReadAll(o)
+	if err != nil {
+		return
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+func (b *Blobs) setRefs(hash string, count int) (err error) {
+	return b.store.Put(BlobKey(hash)+refsSuffix, bytes.NewReader([]byte(strconv.Itoa(count))))
+}
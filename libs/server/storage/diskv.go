@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"github.com/peterbourgon/diskv"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Diskv stores files in a diskv store, every key is a path below the base
+// directory. This is the layout secureShareServer always used.
+type Diskv struct {
+	basePath string
+	store    *diskv.Diskv
+}
+
+// NewDiskv returns a Diskv storage below basePath
+func NewDiskv(basePath string) (d *Diskv) {
+	return &Diskv{
+		basePath: basePath,
+		store: diskv.New(diskv.Options{
+			BasePath:          basePath,
+			AdvancedTransform: AdvancedTransformExample,
+			InverseTransform:  InverseTransformExample,
+		}),
+	}
+}
+
+func AdvancedTransformExample(key string) *diskv.PathKey {
+	//log.Printf("Atransform: key: %s\n", key)
+	path := strings.Split(key, "/")
+	last := len(path) - 1
+	//log.Printf("path: '%s', last: '%d\n", path, last)
+	return &diskv.PathKey{
+		Path:     path[:last],
+		FileName: path[last],
+	}
+
+}
+
+// If you provide an AdvancedTransform, you must also provide its
+// inverse:
+
+func InverseTransformExample(pathKey *diskv.PathKey) (key string) {
+	//log.Printf("revTransform: pathKey: %+v\n", pathKey)
+	key = strings.Join(pathKey.Path, "/") + "/" + pathKey.FileName
+	//log.Printf("revTransform: key: %s\n", key)
+	return key
+
+}
+
+func (d *Diskv) path(key string) (path string, err error) {
+	if !validKey(key) {
+		return "", notExist("open", key)
+	}
+	return filepath.Join(d.basePath, filepath.FromSlash(key)), nil
+}
+
+func (d *Diskv) Put(key string, r io.Reader) (err error) {
+	if !validKey(key) {
+		return notExist("put", key)
+	}
+	return d.store.WriteStream(key, r, true)
+}
+
+func (d *Diskv) Get(key string) (o Object, err error) {
+	path, err := d.path(key)
+	if err != nil {
+		return
+	}
+	return os.Open(path)
+}
+
+func (d *Diskv) Delete(key string) (err error) {
+	if !validKey(key) {
+		return notExist("delete", key)
+	}
+	return d.store.Erase(key)
+}
+
+func (d *Diskv) List(prefix string) (keys []string, err error) {
+	for k := range d.store.KeysPrefix(prefix, nil) {
+		keys = append(keys, k)
+	}
+	return
+}
+
+func (d *Diskv) Stat(key string) (info *Info, err error) {
+	path, err := d.path(key)
+	if err != nil {
+		return
+	}
+	return statFile(path)
+}
+
+// Import hard links the file at path into the store, or copies it where
+// linking is not possible.
+func (d *Diskv) Import(path, key string) (err error) {
+	dst, err := d.path(key)
+	if err != nil {
+		return
+	}
+	err = linkFile(path, dst)
+	if err != nil {
+		if Debug {
+			log.Printf("linking '%s' failed, copying instead: %s\n", key, err.Error())
+		}
+		err = d.store.Import(path, key, false)
+	}
+	return
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Filesystem stores files as plain files below a base directory, every
+// key is a path below it. Files are written to a temporary file first and
+// renamed into place, so readers never see partial data.
+type Filesystem struct {
+	basePath string
+}
+
+// NewFilesystem returns a Filesystem storage below basePath
+func NewFilesystem(basePath string) (fs *Filesystem) {
+	return &Filesystem{basePath: basePath}
+}
+
+// validKey reports whether key is a relative path that stays within the
+// base directory of a storage.
+func validKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") {
+		return false
+	}
+	for _, element := range strings.Split(key, "/") {
+		if element == "" || element == "." || element == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+func (fs *Filesystem) path(key string) (path string, err error) {
+	if !validKey(key) {
+		return "", notExist("open", key)
+	}
+	return filepath.Join(fs.basePath, filepath.FromSlash(key)), nil
+}
+
+func (fs *Filesystem) Put(key string, r io.Reader) (err error) {
+	path, err := fs.path(key)
+	if err != nil {
+		return
+	}
+	dir := filepath.Dir(path)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return
+	}
+	f, err := ioutil.TempFile(dir, ".put-")
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return
+}
+
+func (fs *Filesystem) Get(key string) (o Object, err error) {
+	path, err := fs.path(key)
+	if err != nil {
+		return
+	}
+	return os.Open(path)
+}
+
+func (fs *Filesystem) Delete(key string) (err error) {
+	path, err := fs.path(key)
+	if err != nil {
+		return
+	}
+	err = os.Remove(path)
+	if err != nil {
+		return
+	}
+	// remove directories that became empty, up to the base directory
+	for dir := filepath.Dir(path); dir != filepath.Clean(fs.basePath); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (fs *Filesystem) List(prefix string) (keys []string, err error) {
+	err = filepath.Walk(fs.basePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(fs.basePath, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(filepath.Base(key), ".put-") || !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	return
+}
+
+func (fs *Filesystem) Stat(key string) (info *Info, err error) {
+	path, err := fs.path(key)
+	if err != nil {
+		return
+	}
+	return statFile(path)
+}
+
+// Import hard links the file at path into the store, or copies it where
+// linking is not possible.
+func (fs *Filesystem) Import(path, key string) (err error) {
+	dst, err := fs.path(key)
+	if err != nil {
+		return
+	}
+	err = linkFile(path, dst)
+	if err != nil {
+		if Debug {
+			log.Printf("linking '%s' failed, copying instead: %s\n", key, err.Error())
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return fs.Put(key, f)
+	}
+	return
+}
+
+// linkFile hard links src to dst, replacing dst if it exists
+func linkFile(src, dst string) (err error) {
+	err = os.MkdirAll(filepath.Dir(dst), 0700)
+	if err != nil {
+		return
+	}
+	os.Remove(dst)
+	return os.Link(src, dst)
+}
+
+// statFile returns the Info of a local file
+func statFile(path string) (info *Info, err error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if fi.IsDir() {
+		return nil, notExist("stat", path)
+	}
+	return &Info{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"bytes"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metaSuffix is appended to the key of a file to get the key its metadata
+// is stored under.
+const metaSuffix = ".meta"
+
+// Meta holds what the server knows about a stored file
+type Meta struct {
+	Uploaded   time.Time // time the file was uploaded
+	Size       int64     // size of the (encrypted) file in byte
+	Sender     string    // (salted hash) username of the sender, empty if unknown
+	Expires    time.Time // time the file expires, zero if it does not
+	Downloads  int       // number of times the file has been downloaded
+	Hash       string    // common.LongID of the file content
+	Recipients int       // number of recipients the file was uploaded for
+	Blob       bool      // content is kept in the blob named by Hash, not under the key of the file
+}
+
+// MetaStore keeps Meta records alongside the files in a Storage
+type MetaStore struct {
+	store Storage
+	mu    sync.Mutex
+}
+
+// NewMetaStore returns a MetaStore keeping its records in the given store
+func NewMetaStore(store Storage) (m *MetaStore) {
+	return &MetaStore{store: store}
+}
+
+// MetaKey returns the key the metadata of the file stored under key is
+// kept under.
+func MetaKey(key string) string {
+	return key + metaSuffix
+}
+
+// FileKey returns the key of the file a metadata key belongs to
+func FileKey(metaKey string) string {
+	return strings.TrimSuffix(metaKey, metaSuffix)
+}
+
+// IsMetaKey reports whether key is the key of a metadata record
+func IsMetaKey(key string) bool {
+	return strings.HasSuffix(key, metaSuffix)
+}
+
+// Read returns the metadata of the file stored under key
+func (m *MetaStore) Read(key string) (meta *Meta, err error) {
+	o, err := m.store.Get(MetaKey(key))
+	if err != nil {
+		return
+	}
+	defer o.Close()
+	data, err := ioutil.ReadAll(o)
+	if err != nil {
+		return
+	}
+	meta = new(Meta)
+	err = yaml.Unmarshal(data, meta)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Write stores the metadata of the file stored under key
+func (m *MetaStore) Write(key string, meta *Meta) (err error) {
+	data, err := yaml.Marshal(meta)
+	if err != nil {
+		return
+	}
+	return m.store.Put(MetaKey(key), bytes.NewReader(data))
+}
+
+// Update applies fn to the metadata of the file stored under key and saves
+// the result. Concurrent updates are serialized.
+func (m *MetaStore) Update(key string, fn func(meta *Meta)) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	meta, err := m.Read(key)
+	if err != nil {
+		return
+	}
+	fn(meta)
+	return m.Write(key, meta)
+}
+
+// Erase removes the metadata of the file stored under key, if any
+func (m *MetaStore) Erase(key string) (err error) {
+	err = m.store.Delete(MetaKey(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return
+}
+
+// Claim removes the metadata of the file stored under key and returns it.
+// Of concurrent claims for the same key only one succeeds, the others get
+// an error satisfying os.IsNotExist.
+func (m *MetaStore) Claim(key string) (meta *Meta, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	meta, err = m.Read(key)
+	if err != nil {
+		return
+	}
+	err = m.store.Delete(MetaKey(key))
+	if err != nil {
+		return nil, err
+	}
+	return
+}
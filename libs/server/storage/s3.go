@@ -0,0 +1,376 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 stores files in a bucket of an S3 compatible object storage, like AWS
+// S3 or MinIO. Requests are signed with AWS signature version 4 and use
+// path style URLs (endpoint/bucket/key).
+type S3 struct {
+	endpoint   *url.URL
+	region     string
+	bucket     string
+	accessKey  string
+	secretKey  string
+	httpClient *http.Client
+}
+
+// NewS3 returns a S3 storage for the given bucket
+func NewS3(endpoint, region, bucket, accessKey, secretKey string) (s *S3, err error) {
+	if endpoint == "" || bucket == "" {
+		return nil, fmt.Errorf("s3 storage needs an endpoint and a bucket")
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	s = &S3{
+		endpoint:   u,
+		region:     region,
+		bucket:     bucket,
+		accessKey:  accessKey,
+		secretKey:  secretKey,
+		httpClient: new(http.Client),
+	}
+	return
+}
+
+// SetHttpClient sets the http.Client used to talk to the S3 service
+func (s *S3) SetHttpClient(hc *http.Client) {
+	s.httpClient = hc
+}
+
+func (s *S3) Put(key string, r io.Reader) (err error) {
+	if !validKey(key) {
+		return notExist("put", key)
+	}
+	// S3 needs to know the size of an object before it is sent
+	size := int64(-1)
+	switch v := r.(type) {
+	case *os.File:
+		fi, err := v.Stat()
+		if err != nil {
+			return err
+		}
+		size = fi.Size()
+	case interface{ Len() int }:
+		size = int64(v.Len())
+	}
+	if size < 0 {
+		tmp, err := ioutil.TempFile("", "secureshare-s3-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		size, err = io.Copy(tmp, r)
+		if err != nil {
+			return err
+		}
+		_, err = tmp.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		r = tmp
+	}
+	var body io.ReadCloser
+	if size > 0 {
+		body = ioutil.NopCloser(r)
+	}
+	req, err := s.newRequest("PUT", key, nil, body)
+	if err != nil {
+		return
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := s.do(req)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	return
+}
+
+func (s *S3) Get(key string) (o Object, err error) {
+	info, err := s.Stat(key)
+	if err != nil {
+		return
+	}
+	return &s3Object{s: s, key: key, size: info.Size}, nil
+}
+
+func (s *S3) Delete(key string) (err error) {
+	if !validKey(key) {
+		return notExist("delete", key)
+	}
+	// S3 does not complain about missing objects, other backends do
+	_, err = s.Stat(key)
+	if err != nil {
+		return
+	}
+	req, err := s.newRequest("DELETE", key, nil, nil)
+	if err != nil {
+		return
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	return
+}
+
+// listBucketResult is the part of a ListObjectsV2 response we care about
+type listBucketResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key string
+	}
+}
+
+func (s *S3) List(prefix string) (keys []string, err error) {
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := s.newRequest("GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.do(req)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *S3) Stat(key string) (info *Info, err error) {
+	if !validKey(key) {
+		return nil, notExist("stat", key)
+	}
+	req, err := s.newRequest("HEAD", key, nil, nil)
+	if err != nil {
+		return
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	info = &Info{Size: resp.ContentLength}
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return
+}
+
+// do sends a signed request, responses other than 2xx are returned as error
+func (s *S3) do(req *http.Request) (resp *http.Response, err error) {
+	resp, err = s.httpClient.Do(req)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode == 404 {
+		resp.Body.Close()
+		return nil, notExist(strings.ToLower(req.Method), req.URL.Path)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, body)
+	}
+	return
+}
+
+// newRequest returns a signed request for the given key of the bucket.
+// The payload is not signed, so bodies can be streamed.
+func (s *S3) newRequest(method, key string, query url.Values, body io.ReadCloser) (req *http.Request, err error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+	req, err = http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return
+	}
+	if body != nil {
+		req.Body = body
+	}
+	s.sign(req, time.Now().UTC(), unsignedPayload)
+	return
+}
+
+// unsignedPayload is sent as payload hash for bodies that are not signed
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// sign adds an AWS signature version 4 for the given payload hash to req
+func (s *S3) sign(req *http.Request, now time.Time, payloadHash string) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes query the way signature version 4 expects it,
+// sorted by key and with every reserved character escaped.
+func canonicalQuery(query url.Values) string {
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			params = append(params, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// uriEncode escapes everything but unreserved characters, slashes are kept
+// unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Object reads an object with ranged GET requests, a new request is made
+// whenever the read position was moved by Seek.
+type s3Object struct {
+	s    *S3
+	key  string
+	size int64
+	pos  int64
+	body io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (n int, err error) {
+	if o.pos >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		req, err := o.s.newRequest("GET", o.key, nil, nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(o.pos, 10)+"-")
+		resp, err := o.s.do(req)
+		if err != nil {
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+	n, err = o.body.Read(p)
+	o.pos += int64(n)
+	return
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (pos int64, err error) {
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = o.pos + offset
+	case io.SeekEnd:
+		pos = o.size + offset
+	}
+	if pos < 0 {
+		return o.pos, fmt.Errorf("s3: negative position")
+	}
+	if pos != o.pos && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.pos = pos
+	return
+}
+
+func (o *s3Object) Close() (err error) {
+	if o.body != nil {
+		err = o.body.Close()
+		o.body = nil
+	}
+	return
+}
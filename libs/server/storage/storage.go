@@ -0,0 +1,80 @@
+// storage - secureShareServer file storage module
+package storage
+
+import (
+	"fmt"
+	"github.com/scusi/secureShare/libs/server/config"
+	"io"
+	"os"
+	"time"
+)
+
+var Debug bool
+
+// Storage is implemented by the backends uploaded files are kept in.
+// Keys are slash separated paths, like "username/fileID".
+// Errors for keys that do not exist satisfy os.IsNotExist.
+type Storage interface {
+	// Put stores the data read from r under key, replacing existing data
+	Put(key string, r io.Reader) error
+	// Get opens the data stored under key for reading
+	Get(key string) (Object, error)
+	// Delete removes the data stored under key
+	Delete(key string) error
+	// List returns all keys starting with prefix
+	List(prefix string) ([]string, error)
+	// Stat returns information about the data stored under key
+	Stat(key string) (*Info, error)
+}
+
+// Object is stored data opened for reading
+type Object interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// Info describes stored data
+type Info struct {
+	Size    int64     // size in byte
+	ModTime time.Time // time the data was written
+}
+
+// Importer is implemented by backends that can take over a local file
+// without copying its content, e.g. by hard linking it.
+type Importer interface {
+	Import(path, key string) error
+}
+
+// New returns the storage backend selected in the config
+func New(cfg *config.Config) (s Storage, err error) {
+	switch cfg.Storage {
+	case "", "diskv":
+		return NewDiskv(cfg.DataDir), nil
+	case "filesystem":
+		return NewFilesystem(cfg.DataDir), nil
+	case "s3":
+		return NewS3(cfg.S3Endpoint, cfg.S3Region, cfg.S3Bucket, cfg.S3AccessKey, cfg.S3SecretKey)
+	default:
+		return nil, fmt.Errorf("unknown storage backend '%s'", cfg.Storage)
+	}
+}
+
+// StoreFile stores the local file at path under key. Backends implementing
+// Importer take the file over directly, all others get a copy.
+func StoreFile(s Storage, path, key string) (err error) {
+	if i, ok := s.(Importer); ok {
+		return i.Import(path, key)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	return s.Put(key, f)
+}
+
+// notExist returns the error for a key that does not exist
+func notExist(op, key string) error {
+	return &os.PathError{Op: op, Path: key, Err: os.ErrNotExist}
+}
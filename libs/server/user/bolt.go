@@ -0,0 +1,227 @@
+package user
+
+import (
+	"fmt"
+	"go.etcd.io/bbolt"
+	"gopkg.in/yaml.v2"
+	"time"
+)
+
+// usersBucket is the bucket users are kept in, by username
+var usersBucket = []byte("users")
+
+// BoltDB keeps users in a bbolt key-value database. Every change is a
+// single transaction, the database is not rewritten on every registration.
+type BoltDB struct {
+	Path string
+	db   *bbolt.DB
+}
+
+// OpenBolt opens, or creates, the bbolt user database at path
+func OpenBolt(path string) (b *BoltDB, err error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(usersBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return
+	}
+	return &BoltDB{Path: path, db: db}, nil
+}
+
+// getUser reads a user within a transaction, nil if there is none
+func getUser(tx *bbolt.Tx, username string) (u *User, err error) {
+	data := tx.Bucket(usersBucket).Get([]byte(username))
+	if data == nil {
+		return nil, nil
+	}
+	u = new(User)
+	err = yaml.Unmarshal(data, u)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// putUser writes a user within a transaction
+func putUser(tx *bbolt.Tx, u *User) (err error) {
+	data, err := yaml.Marshal(u)
+	if err != nil {
+		return
+	}
+	return tx.Bucket(usersBucket).Put([]byte(u.Name), data)
+}
+
+// get returns the user with the given username, nil if there is none
+func (b *BoltDB) get(username string) (u *User, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) (err error) {
+		u, err = getUser(tx, username)
+		return
+	})
+	return
+}
+
+// Get returns the user with the given username
+func (b *BoltDB) Get(username string) (u *User, err error) {
+	u, err = b.get(username)
+	if err == nil && u == nil {
+		err = ErrNotFound
+	}
+	return
+}
+
+// Update applies fn to the user with the given username and saves the
+// result, all within one transaction.
+func (b *BoltDB) Update(username string, fn func(u *User) error) (err error) {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		u, err := getUser(tx, username)
+		if err != nil {
+			return err
+		}
+		if u == nil {
+			return ErrNotFound
+		}
+		err = fn(u)
+		if err != nil {
+			return err
+		}
+		return putUser(tx, u)
+	})
+}
+
+func (b *BoltDB) Add(username, publicKey string) (token string, err error) {
+	err = b.db.Update(func(tx *bbolt.Tx) error {
+		old, err := getUser(tx, username)
+		if err != nil {
+			return err
+		}
+		if old != nil {
+			return fmt.Errorf("invalid username, please choose another one.")
+		}
+		u, t, err := newUser(username, publicKey)
+		if err != nil {
+			return err
+		}
+		err = putUser(tx, u)
+		if err != nil {
+			return err
+		}
+		token = t
+		return nil
+	})
+	if err != nil {
+		token = ""
+	}
+	return
+}
+
+func (b *BoltDB) Delete(username string) (err error) {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		if tx.Bucket(usersBucket).Get([]byte(username)) == nil {
+			return ErrNotFound
+		}
+		return tx.Bucket(usersBucket).Delete([]byte(username))
+	})
+}
+
+func (b *BoltDB) Lookup(username string) (ok bool) {
+	b.db.View(func(tx *bbolt.Tx) error {
+		ok = tx.Bucket(usersBucket).Get([]byte(username)) != nil
+		return nil
+	})
+	return
+}
+
+func (b *BoltDB) PublicKey(username string) (publicKey string) {
+	u, err := b.get(username)
+	if err != nil || u == nil {
+		return ""
+	}
+	return u.PublicKey
+}
+
+func (b *BoltDB) APIAuthenticate(username, APIToken string) (ok bool) {
+	_, ok = b.TokenName(username, APIToken)
+	return
+}
+
+func (b *BoltDB) TokenName(username, APIToken string) (name string, ok bool) {
+	u, err := b.get(username)
+	if err != nil || u == nil {
+		return "", false
+	}
+	return u.tokenName(APIToken)
+}
+
+func (b *BoltDB) NewAPIToken(username string) (APIToken string, err error) {
+	err = b.Update(username, func(u *User) error {
+		APIToken = u.resetTokens()
+		return nil
+	})
+	return
+}
+
+func (b *BoltDB) Tokens(username string) (tokens []Token, err error) {
+	u, err := b.get(username)
+	if err != nil {
+		return
+	}
+	if u == nil {
+		return nil, ErrNotFound
+	}
+	return u.Tokens, nil
+}
+
+func (b *BoltDB) CreateToken(username, name string) (APIToken string, err error) {
+	err = b.Update(username, func(u *User) (err error) {
+		APIToken, err = u.createToken(name)
+		return
+	})
+	return
+}
+
+func (b *BoltDB) RotateToken(username, name string) (APIToken string, err error) {
+	err = b.Update(username, func(u *User) (err error) {
+		APIToken, err = u.rotateToken(name)
+		return
+	})
+	return
+}
+
+func (b *BoltDB) RevokeToken(username, name string) (err error) {
+	return b.Update(username, func(u *User) error {
+		return u.revokeToken(name)
+	})
+}
+
+func (b *BoltDB) List() (users []User, err error) {
+	err = b.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(usersBucket).ForEach(func(k, v []byte) error {
+			var u User
+			err := yaml.Unmarshal(v, &u)
+			if err != nil {
+				return err
+			}
+			users = append(users, u)
+			return nil
+		})
+	})
+	return
+}
+
+func (b *BoltDB) Put(u User) (err error) {
+	c := u.clone()
+	c.migrateToken()
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return putUser(tx, c)
+	})
+}
+
+func (b *BoltDB) Close() (err error) {
+	return b.db.Close()
+}
@@ -0,0 +1,154 @@
+package user
+
+import (
+	"crypto/rand"
+	"errors"
+	"github.com/decred/base58"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Invite is a single-use code that allows to register when the server runs
+// in invite mode.
+type Invite struct {
+	Code    string    // random base58 code handed to the invited person
+	Note    string    `yaml:",omitempty"` // reminder for the admin whom the invite is for
+	Created time.Time // time the invite was created
+	Expires time.Time `yaml:",omitempty"` // time the invite becomes invalid, zero if it does not expire
+}
+
+// ErrInvalidInvite is returned for invite codes that do not exist or expired
+var ErrInvalidInvite = errors.New("invalid invite code")
+
+// Invites holds the unused invite codes. It is safe for concurrent use,
+// changes are written to Path atomically.
+type Invites struct {
+	Path    string
+	Invites []Invite
+
+	mu sync.Mutex
+}
+
+// LoadInvites loads the invites from a yaml file, a missing file holds no
+// invites.
+func LoadInvites(path string) (inv *Invites, err error) {
+	inv = &Invites{Path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return inv, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = yaml.Unmarshal(data, &inv.Invites)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// save writes the invites to inv.Path, the caller holds the lock
+func (inv *Invites) save() (err error) {
+	data, err := yaml.Marshal(inv.Invites)
+	if err != nil {
+		return
+	}
+	return writeFile(inv.Path, data)
+}
+
+// Create adds a new invite, it expires after ttl unless ttl is 0
+func (inv *Invites) Create(note string, ttl time.Duration) (i Invite, err error) {
+	code := make([]byte, 16)
+	_, err = rand.Read(code)
+	if err != nil {
+		return
+	}
+	i = Invite{
+		Code:    base58.Encode(code),
+		Note:    note,
+		Created: time.Now(),
+	}
+	if ttl > 0 {
+		i.Expires = i.Created.Add(ttl)
+	}
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.Invites = append(inv.Invites, i)
+	err = inv.save()
+	if err != nil {
+		inv.Invites = inv.Invites[:len(inv.Invites)-1]
+	}
+	return
+}
+
+// List returns all invites that were not used yet
+func (inv *Invites) List() (invites []Invite) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	return append(invites, inv.Invites...)
+}
+
+// Valid reports whether code is an unused invite that did not expire
+func (inv *Invites) Valid(code string) bool {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	i := inv.find(code)
+	return i >= 0 && !inv.Invites[i].expired()
+}
+
+// Use consumes the invite with the given code, every invite can be used once
+func (inv *Invites) Use(code string) (err error) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	i := inv.find(code)
+	if i < 0 || inv.Invites[i].expired() {
+		return ErrInvalidInvite
+	}
+	return inv.remove(i)
+}
+
+// Revoke removes the invite with the given code
+func (inv *Invites) Revoke(code string) (err error) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	i := inv.find(code)
+	if i < 0 {
+		return ErrInvalidInvite
+	}
+	return inv.remove(i)
+}
+
+// find returns the position of the invite with the given code, -1 if there
+// is none. The caller holds the lock.
+func (inv *Invites) find(code string) int {
+	if code == "" {
+		return -1
+	}
+	for i := range inv.Invites {
+		if inv.Invites[i].Code == code {
+			return i
+		}
+	}
+	return -1
+}
+
+// remove deletes the invite at position i, the caller holds the lock
+func (inv *Invites) remove(i int) (err error) {
+	old := inv.Invites
+	invites := make([]Invite, 0, len(old)-1)
+	invites = append(invites, old[:i]...)
+	inv.Invites = append(invites, old[i+1:]...)
+	err = inv.save()
+	if err != nil {
+		inv.Invites = old
+	}
+	return
+}
+
+// expired reports whether the invite can not be used anymore
+func (i Invite) expired() bool {
+	return !i.Expires.IsZero() && time.Now().After(i.Expires)
+}
@@ -0,0 +1,243 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/cathalgarvey/go-minilock/taber"
+	"github.com/dchest/blake2b"
+	"github.com/scusi/secureShare/libs/server/config"
+	"log"
+	"time"
+)
+
+var Debug bool
+
+type User struct {
+	Name      string  // username choosen by the user
+	APIToken  string  `yaml:",omitempty"` // cleartext token of older versions, moved to Tokens on load
+	PublicKey string  // minilock EncodeID of the user
+	Tokens    []Token // server issued tokens to authenticate to the secureShare API
+	Pending   bool    `yaml:",omitempty"` // account waits for the approval of an admin
+	Disabled  bool    `yaml:",omitempty"` // account was disabled by an admin
+}
+
+// Token is a named API token of a user, e.g. one per device. Only a salted
+// hash of the token is stored.
+type Token struct {
+	Name    string    // name of the token, unique per user
+	Salt    string    // hex encoded random salt
+	Hash    string    // hex encoded salted blake2b hash of the token
+	Created time.Time // time the token was issued
+}
+
+// DefaultTokenName is the name of the token issued on registration
+const DefaultTokenName = "default"
+
+// ErrNotFound is returned for users that do not exist
+var ErrNotFound = errors.New("user was not found")
+
+// ErrInvalidPublicKey is returned when adding a user whose public key is no
+// valid minilock ID.
+var ErrInvalidPublicKey = errors.New("invalid public key")
+
+// UserStore is implemented by the backends users are kept in. All
+// implementations are safe for concurrent use.
+type UserStore interface {
+	// Add adds a new user and returns the API token issued to it
+	Add(username, publicKey string) (token string, err error)
+	// Delete removes the user with the given username
+	Delete(username string) error
+	// Lookup reports whether a user with the given username exists
+	Lookup(username string) bool
+	// PublicKey returns the public key of the given user
+	PublicKey(username string) string
+	// APIAuthenticate checks if APIToken is one of the tokens of the given user
+	APIAuthenticate(username, APIToken string) bool
+	// TokenName returns the name of the token APIToken of the given user
+	TokenName(username, APIToken string) (name string, ok bool)
+	// NewAPIToken replaces all tokens of the given user with a new one
+	NewAPIToken(username string) (APIToken string, err error)
+	// Tokens returns the tokens of the given user
+	Tokens(username string) ([]Token, error)
+	// CreateToken issues a new token with the given name to a user
+	CreateToken(username, name string) (APIToken string, err error)
+	// RotateToken replaces the token with the given name with a new one
+	RotateToken(username, name string) (APIToken string, err error)
+	// RevokeToken removes the token with the given name
+	RevokeToken(username, name string) error
+	// List returns all users
+	List() ([]User, error)
+	// Get returns the user with the given username
+	Get(username string) (*User, error)
+	// Update applies fn to the user with the given username and saves the result
+	Update(username string, fn func(u *User) error) error
+	// Put stores u as it is, replacing a user with the same name
+	Put(u User) error
+	// Close releases the resources of the store
+	Close() error
+}
+
+// Open opens the user store selected in the config
+func Open(cfg *config.Config) (s UserStore, err error) {
+	switch cfg.UserStore {
+	case "", "yaml":
+		return LoadFromFile(cfg.UsersFile)
+	case "bolt":
+		return OpenBolt(cfg.UsersFile)
+	default:
+		return nil, fmt.Errorf("unknown user store '%s'", cfg.UserStore)
+	}
+}
+
+// newUser returns a new user with a token named DefaultTokenName. The
+// publicKey has to be a valid minilock ID.
+func newUser(username, publicKey string) (u *User, token string, err error) {
+	if _, err = taber.FromID(publicKey); err != nil {
+		return nil, "", ErrInvalidPublicKey
+	}
+	u = new(User)
+	u.Name = username
+	u.PublicKey = publicKey
+	token = newAPIToken()
+	u.Tokens = []Token{hashToken(DefaultTokenName, token)}
+	return
+}
+
+// clone returns a copy of u that shares no memory with u
+func (u *User) clone() (c *User) {
+	c = new(User)
+	*c = *u
+	c.Tokens = append([]Token(nil), u.Tokens...)
+	return
+}
+
+// migrateToken replaces the cleartext APIToken of older versions with a
+// hashed token named DefaultTokenName. It reports whether u was changed.
+func (u *User) migrateToken() (changed bool) {
+	if u.APIToken == "" {
+		return false
+	}
+	u.Tokens = append(u.Tokens, hashToken(DefaultTokenName, u.APIToken))
+	u.APIToken = ""
+	return true
+}
+
+// Active reports whether the user can use the API
+func (u *User) Active() bool {
+	return !u.Pending && !u.Disabled
+}
+
+// tokenName returns the name of the token APIToken, all tokens of the user
+// are compared in constant time. Inactive users have no valid tokens.
+func (u *User) tokenName(APIToken string) (name string, ok bool) {
+	if APIToken == "" || !u.Active() {
+		return "", false
+	}
+	for _, t := range u.Tokens {
+		if t.matches(APIToken) {
+			name = t.Name
+			ok = true
+		}
+	}
+	return
+}
+
+// resetTokens replaces all tokens with a new token named DefaultTokenName
+func (u *User) resetTokens() (APIToken string) {
+	APIToken = newAPIToken()
+	u.APIToken = ""
+	u.Tokens = []Token{hashToken(DefaultTokenName, APIToken)}
+	return
+}
+
+// createToken adds a new token with the given name
+func (u *User) createToken(name string) (APIToken string, err error) {
+	if name == "" {
+		err = fmt.Errorf("token name is empty")
+		return
+	}
+	for _, t := range u.Tokens {
+		if t.Name == name {
+			err = fmt.Errorf("token '%s' does exist already", name)
+			return
+		}
+	}
+	APIToken = newAPIToken()
+	u.Tokens = append(u.Tokens, hashToken(name, APIToken))
+	return
+}
+
+// rotateToken replaces the token with the given name with a new one
+func (u *User) rotateToken(name string) (APIToken string, err error) {
+	for i, t := range u.Tokens {
+		if t.Name == name {
+			APIToken = newAPIToken()
+			u.Tokens[i] = hashToken(name, APIToken)
+			return
+		}
+	}
+	err = fmt.Errorf("token '%s' was not found", name)
+	return
+}
+
+// revokeToken removes the token with the given name. The last token can not
+// be revoked.
+func (u *User) revokeToken(name string) (err error) {
+	for i, t := range u.Tokens {
+		if t.Name == name {
+			if len(u.Tokens) == 1 {
+				return fmt.Errorf("the last token can not be revoked")
+			}
+			u.Tokens = append(u.Tokens[:i], u.Tokens[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("token '%s' was not found", name)
+}
+
+// newAPIToken - generates a new random token for API usage
+func newAPIToken() (token string) {
+	t := make([]byte, 32)
+	rand.Read(t)
+	return fmt.Sprintf("%x", t)
+}
+
+// hashToken returns the Token with the given name for a cleartext token
+func hashToken(name, token string) (t Token) {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	return Token{
+		Name:    name,
+		Salt:    fmt.Sprintf("%x", salt),
+		Hash:    fmt.Sprintf("%x", tokenHash(salt, token)),
+		Created: time.Now(),
+	}
+}
+
+// tokenHash - computes the salted hash of a token
+func tokenHash(salt []byte, token string) (sum []byte) {
+	h, err := blake2b.New(&blake2b.Config{Size: 32, Salt: salt, Person: []byte("ssToken")})
+	if err != nil {
+		log.Printf("ERROR creating token hash: %s\n", err.Error())
+		return nil
+	}
+	h.Write([]byte(token))
+	return h.Sum(nil)
+}
+
+// matches reports whether token is the cleartext of t
+func (t Token) matches(token string) bool {
+	salt, err := hex.DecodeString(t.Salt)
+	if err != nil {
+		return false
+	}
+	hash, err := hex.DecodeString(t.Hash)
+	if err != nil {
+		return false
+	}
+	sum := tokenHash(salt, token)
+	return sum != nil && subtle.ConstantTimeCompare(sum, hash) == 1
+}
@@ -1,24 +1,23 @@
 package user
 
 import (
-	"crypto/rand"
 	"fmt"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"sync"
 )
 
-var Debug bool
-
-type User struct {
-	Name      string // username choosen by the user
-	APIToken  string // server issued token to authenticate to the secureShare API
-	PublicKey string // minilock EncodeID of the user
-}
-
+// UserDB holds the users of secureShare. It is safe for concurrent use,
+// changes are written to Path atomically.
 type UserDB struct {
 	Path  string
 	Users []User
+
+	mu    sync.RWMutex
+	index map[string]int // position of a user in Users by name
 }
 
 /* From within your program you do this:
@@ -47,6 +46,30 @@ func main() {
 
 /* LoadFromFile - loads a user database from a yaml file */
 func LoadFromFile(path string) (udb *UserDB, err error) {
+	udb, migrated, err := readFile(path)
+	if err != nil {
+		return
+	}
+	// move cleartext tokens of older versions to hashed tokens
+	if migrated {
+		err = udb.Save("")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// ReadFromFile reads a yaml user database like LoadFromFile, but leaves the
+// file alone. Cleartext tokens of older versions are only migrated in memory.
+func ReadFromFile(path string) (udb *UserDB, err error) {
+	udb, _, err = readFile(path)
+	return
+}
+
+// readFile decodes the yaml user database at path, migrated tells whether
+// tokens were migrated in memory.
+func readFile(path string) (udb *UserDB, migrated bool, err error) {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return
@@ -58,19 +81,39 @@ func LoadFromFile(path string) (udb *UserDB, err error) {
 	if err != nil {
 		return
 	}
+	ul.reindex()
+	migrated = ul.migrateTokens()
+	return ul, migrated, nil
+}
+
+// migrateTokens replaces the cleartext APIToken of users with a hashed
+// token named DefaultTokenName. It reports whether a user was changed.
+func (udb *UserDB) migrateTokens() (changed bool) {
+	for i := range udb.Users {
+		if udb.Users[i].migrateToken() {
+			changed = true
+		}
+	}
+	return
+}
 
-	// return
-	return ul, nil
+// reindex rebuilds the index of the users by name
+func (udb *UserDB) reindex() {
+	udb.index = make(map[string]int, len(udb.Users))
+	for i, u := range udb.Users {
+		udb.index[u.Name] = i
+	}
 }
 
 /* SaveToFile - saves a given user database to a given file */
-func SaveToFile(udb UserDB, path string) (err error) {
+func SaveToFile(udb *UserDB, path string) (err error) {
+	udb.mu.RLock()
+	defer udb.mu.RUnlock()
 	ydata, err := yaml.Marshal(udb.Users)
 	if err != nil {
 		return
 	}
-	udb.Path = path
-	err = ioutil.WriteFile(path, ydata, 0700)
+	err = writeFile(path, ydata)
 	if err != nil {
 		return
 	}
@@ -78,127 +121,282 @@ func SaveToFile(udb UserDB, path string) (err error) {
 	return
 }
 
+// Save writes the user database to path, or to udb.Path if path is empty
 func (udb *UserDB) Save(path string) (err error) {
+	udb.mu.Lock()
+	defer udb.mu.Unlock()
 	if path != "" {
 		udb.Path = path
 	}
+	return udb.save()
+}
+
+// save writes the user database to udb.Path, the caller holds the lock
+func (udb *UserDB) save() (err error) {
 	ydata, err := yaml.Marshal(udb)
 	if err != nil {
 		return
 	}
-	if path != "" {
-		err = ioutil.WriteFile(path, ydata, 0700)
-		log.Printf("saved to: %s\n", path)
-	} else {
-		err = ioutil.WriteFile(udb.Path, ydata, 0700)
+	err = writeFile(udb.Path, ydata)
+	if err != nil {
+		return
+	}
+	if Debug {
 		log.Printf("saved to: %s\n", udb.Path)
 	}
 	return
 }
 
-func (udb *UserDB) Add(username, publicKey string) (err error) {
+// writeFile writes data to a temporary file next to path and renames it to
+// path, so path always holds either the old or the new data.
+func writeFile(path string, data []byte) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return
+}
+
+// Add adds a new user and returns the API token issued to it
+func (udb *UserDB) Add(username, publicKey string) (token string, err error) {
 	if Debug {
 		log.Printf("userDB.Add: username: '%s'", username)
 	}
-	doesExist := udb.Lookup(username)
-	if doesExist {
+	udb.mu.Lock()
+	defer udb.mu.Unlock()
+	if udb.index == nil {
+		udb.reindex()
+	}
+	if udb.user(username) != nil {
 		err = fmt.Errorf("invalid username, please choose another one.")
 		return
 	}
-	u := new(User)
-	u.Name = username
-	// TODO: check if the publicKey is syntactitcal correct
-	u.PublicKey = publicKey
-	u.APIToken = newAPIToken()
+	u, token, err := newUser(username, publicKey)
+	if err != nil {
+		return
+	}
 	udb.Users = append(udb.Users, *u)
-	udb.Save("")
-	if Debug {
-		log.Printf("udb: %#v\n", udb)
+	udb.index[username] = len(udb.Users) - 1
+	err = udb.save()
+	if err != nil {
+		// keep memory and file in sync
+		udb.Users = udb.Users[:len(udb.Users)-1]
+		delete(udb.index, username)
+		token = ""
 	}
 	return
 }
 
+// Delete removes the user with the given username
 func (udb *UserDB) Delete(username string) (err error) {
-	var found bool
-	nudb := UserDB{}
-	nudb = *udb
-	for i, u := range nudb.Users {
-		if u.Name == username {
-			found = true
-			udb.Users = append(nudb.Users[:i], nudb.Users[i+1:]...)
-			//udb = &nudb
-			return
+	udb.mu.Lock()
+	defer udb.mu.Unlock()
+	if udb.user(username) == nil {
+		return ErrNotFound
+	}
+	users := make([]User, 0, len(udb.Users)-1)
+	for _, u := range udb.Users {
+		if u.Name != username {
+			users = append(users, u)
 		}
 	}
-	if found != true {
-		err = fmt.Errorf("user was not found")
+	old := udb.Users
+	udb.Users = users
+	udb.reindex()
+	err = udb.save()
+	if err != nil {
+		udb.Users = old
+		udb.reindex()
 	}
-	udb.Save("")
 	return
 }
 
+// Lookup reports whether a user with the given username exists
 func (udb *UserDB) Lookup(username string) (ok bool) {
-	for _, u := range udb.Users {
-		if u.Name == username {
-			return true
-		}
+	udb.mu.RLock()
+	defer udb.mu.RUnlock()
+	return udb.user(username) != nil
+}
+
+// PublicKey returns the public key of the given user
+func (udb *UserDB) PublicKey(username string) (publicKey string) {
+	udb.mu.RLock()
+	defer udb.mu.RUnlock()
+	if u := udb.user(username); u != nil {
+		return u.PublicKey
 	}
-	return false
+	return
 }
 
-func (udb *UserDB) LookupNameByPubkey(pubkey string) (name string) {
-	for _, u := range udb.Users {
-		if u.PublicKey == pubkey {
-			return u.Name
-		}
+// APIAuthenticate checks if APIToken is one of the tokens of the given user
+func (udb *UserDB) APIAuthenticate(username, APIToken string) (ok bool) {
+	_, ok = udb.TokenName(username, APIToken)
+	return
+}
+
+// TokenName returns the name of the token APIToken of the given user. ok is
+// false if APIToken is not a token of the user. All tokens of the user are
+// compared in constant time.
+func (udb *UserDB) TokenName(username, APIToken string) (name string, ok bool) {
+	udb.mu.RLock()
+	defer udb.mu.RUnlock()
+	u := udb.user(username)
+	if u == nil {
+		return "", false
 	}
-	return ""
+	return u.tokenName(APIToken)
 }
 
-func (udb *UserDB) PublicKey(username string) (publicKey string) {
-	for _, u := range udb.Users {
-		if u.Name == username {
-			return u.PublicKey
+// user returns the user with the given username, nil if there is none.
+// The caller holds the lock.
+func (udb *UserDB) user(username string) (u *User) {
+	if udb.index == nil {
+		// a UserDB that was not loaded, e.g. new(UserDB)
+		for i := range udb.Users {
+			if udb.Users[i].Name == username {
+				return &udb.Users[i]
+			}
 		}
+		return nil
+	}
+	i, ok := udb.index[username]
+	if !ok {
+		return nil
+	}
+	return &udb.Users[i]
+}
+
+// Get returns a copy of the user with the given username
+func (udb *UserDB) Get(username string) (u *User, err error) {
+	udb.mu.RLock()
+	defer udb.mu.RUnlock()
+	found := udb.user(username)
+	if found == nil {
+		return nil, ErrNotFound
+	}
+	return found.clone(), nil
+}
+
+// Update applies fn to the user with the given username and saves the
+// result. If fn or saving fails the user stays unchanged.
+func (udb *UserDB) Update(username string, fn func(u *User) error) (err error) {
+	udb.mu.Lock()
+	defer udb.mu.Unlock()
+	u := udb.user(username)
+	if u == nil {
+		return ErrNotFound
+	}
+	old := u.clone()
+	err = fn(u)
+	if err == nil {
+		err = udb.save()
+	}
+	if err != nil {
+		*u = *old
 	}
 	return
 }
 
-func (udb *UserDB) APIAuthenticate(username, APIToken string) (ok bool) {
-	for _, u := range udb.Users {
-		if u.Name == username {
-			APIToken = u.APIToken
-			return true
-		}
+// NewAPIToken replaces all tokens of the given user with a new token named
+// DefaultTokenName and returns it.
+func (udb *UserDB) NewAPIToken(username string) (APIToken string, err error) {
+	err = udb.Update(username, func(u *User) error {
+		APIToken = u.resetTokens()
+		return nil
+	})
+	return
+}
+
+// Tokens returns the tokens of the given user
+func (udb *UserDB) Tokens(username string) (tokens []Token, err error) {
+	udb.mu.RLock()
+	defer udb.mu.RUnlock()
+	u := udb.user(username)
+	if u == nil {
+		err = ErrNotFound
+		return
 	}
-	return false
+	tokens = append(tokens, u.Tokens...)
+	return
 }
 
-// newAPIToken - generates a new random token for API usage
-func newAPIToken() (token string) {
-	t := make([]byte, 32)
-	rand.Read(t)
-	return fmt.Sprintf("%x", t)
+// CreateToken issues a new token with the given name to a user
+func (udb *UserDB) CreateToken(username, name string) (APIToken string, err error) {
+	err = udb.Update(username, func(u *User) (err error) {
+		APIToken, err = u.createToken(name)
+		return
+	})
+	return
 }
 
-// NewAPIToken will set a a new random API token for a given username
-func (udb *UserDB) NewAPIToken(username string) (APIToken string) {
-	APIToken = newAPIToken()
-	for _, u := range udb.Users {
-		if u.Name == username {
-			u.APIToken = APIToken
-		}
+// RotateToken replaces the token with the given name with a new one
+func (udb *UserDB) RotateToken(username, name string) (APIToken string, err error) {
+	err = udb.Update(username, func(u *User) (err error) {
+		APIToken, err = u.rotateToken(name)
+		return
+	})
+	return
+}
+
+// RevokeToken removes the token with the given name. The last token of a
+// user can not be revoked.
+func (udb *UserDB) RevokeToken(username, name string) (err error) {
+	return udb.Update(username, func(u *User) error {
+		return u.revokeToken(name)
+	})
+}
+
+// List returns all users
+func (udb *UserDB) List() (users []User, err error) {
+	udb.mu.RLock()
+	defer udb.mu.RUnlock()
+	for i := range udb.Users {
+		users = append(users, *udb.Users[i].clone())
 	}
-	udb.Save("")
 	return
 }
 
-// APIToken shows the APIToken for the given user
-func (udb *UserDB) APIToken(username string) (APIToken string) {
-	for _, u := range udb.Users {
-		if u.Name == username {
-			return u.APIToken
+// Put stores u as it is, replacing a user with the same name
+func (udb *UserDB) Put(u User) (err error) {
+	udb.mu.Lock()
+	defer udb.mu.Unlock()
+	if udb.index == nil {
+		udb.reindex()
+	}
+	u = *u.clone()
+	if old := udb.user(u.Name); old != nil {
+		prev := *old
+		*old = u
+		err = udb.save()
+		if err != nil {
+			*old = prev
 		}
+		return
+	}
+	udb.Users = append(udb.Users, u)
+	udb.index[u.Name] = len(udb.Users) - 1
+	err = udb.save()
+	if err != nil {
+		udb.Users = udb.Users[:len(udb.Users)-1]
+		delete(udb.index, u.Name)
 	}
-	return ""
+	return
+}
+
+// Close does nothing, every change is saved right away
+func (udb *UserDB) Close() (err error) {
+	return nil
 }
@@ -0,0 +1,253 @@
+package user
+
+import (
+	"fmt"
+	"github.com/cathalgarvey/go-minilock"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// testPublicKey returns a valid minilock ID, generating keys is slow so it
+// is done once.
+var testPublicKey = func() func(t *testing.T) string {
+	var once sync.Once
+	var id string
+	var err error
+	return func(t *testing.T) string {
+		once.Do(func() {
+			keys, errKey := minilock.GenerateKey("test@example.org", "correct horse battery staple")
+			if errKey != nil {
+				err = errKey
+				return
+			}
+			id, err = keys.EncodeID()
+		})
+		if err != nil {
+			t.Fatalf("generating test key: %s", err)
+		}
+		return id
+	}
+}()
+
+// newTestDB returns an empty UserDB saved in a temporary directory
+func newTestDB(t *testing.T) (udb *UserDB, dir string) {
+	dir, err := ioutil.TempDir("", "userdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udb = &UserDB{Path: filepath.Join(dir, "users.yml")}
+	err = udb.Save("")
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return
+}
+
+// checkIndex fails if the index does not point every name to its user
+func checkIndex(t *testing.T, udb *UserDB) {
+	udb.mu.RLock()
+	defer udb.mu.RUnlock()
+	if len(udb.index) != len(udb.Users) {
+		t.Errorf("index has %d entries for %d users", len(udb.index), len(udb.Users))
+	}
+	for i, u := range udb.Users {
+		if j, ok := udb.index[u.Name]; !ok || j != i {
+			t.Errorf("index of '%s' is %d (%v), want %d", u.Name, j, ok, i)
+		}
+	}
+}
+
+func names(users []User) (n []string) {
+	for _, u := range users {
+		n = append(n, u.Name)
+	}
+	sort.Strings(n)
+	return
+}
+
+func TestConcurrentAddDelete(t *testing.T) {
+	udb, dir := newTestDB(t)
+	defer os.RemoveAll(dir)
+	publicKey := testPublicKey(t)
+	const workers = 8
+	const usersPerWorker = 20
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < usersPerWorker; i++ {
+				name := fmt.Sprintf("user-%d-%d", w, i)
+				if _, err := udb.Add(name, publicKey); err != nil {
+					t.Errorf("adding '%s': %s", name, err)
+					return
+				}
+				if !udb.Lookup(name) {
+					t.Errorf("'%s' not found after adding it", name)
+				}
+				// keep every other user
+				if i%2 == 1 {
+					if err := udb.Delete(name); err != nil {
+						t.Errorf("deleting '%s': %s", name, err)
+					}
+					if udb.Lookup(name) {
+						t.Errorf("'%s' found after deleting it", name)
+					}
+				}
+				copyPath := filepath.Join(dir, fmt.Sprintf("copy-%d.yml", w))
+				if err := SaveToFile(udb, copyPath); err != nil {
+					t.Errorf("saving copy: %s", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	checkIndex(t, udb)
+
+	var want []string
+	for w := 0; w < workers; w++ {
+		for i := 0; i < usersPerWorker; i += 2 {
+			want = append(want, fmt.Sprintf("user-%d-%d", w, i))
+		}
+	}
+	sort.Strings(want)
+	users, err := udb.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(users); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("users in memory:\n%v\nwant:\n%v", got, want)
+	}
+
+	// the file holds what is in memory
+	loaded, err := LoadFromFile(udb.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIndex(t, loaded)
+	if got := names(loaded.Users); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("users in '%s':\n%v\nwant:\n%v", udb.Path, got, want)
+	}
+	for _, name := range want {
+		if !loaded.Lookup(name) || loaded.PublicKey(name) != publicKey {
+			t.Errorf("'%s' was not saved with its public key", name)
+		}
+	}
+
+	copyPath := filepath.Join(dir, "copy.yml")
+	err = SaveToFile(udb, copyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(copyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved []User
+	err = yaml.Unmarshal(data, &saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(saved); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("users in '%s':\n%v\nwant:\n%v", copyPath, got, want)
+	}
+}
+
+func TestConcurrentAddSameName(t *testing.T) {
+	udb, dir := newTestDB(t)
+	defer os.RemoveAll(dir)
+	publicKey := testPublicKey(t)
+	const tries = 16
+	errs := make(chan error, tries)
+	var wg sync.WaitGroup
+	for i := 0; i < tries; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := udb.Add("alice", publicKey)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	added := 0
+	for err := range errs {
+		if err == nil {
+			added++
+		}
+	}
+	if added != 1 {
+		t.Errorf("'alice' was added %d times, want once", added)
+	}
+	checkIndex(t, udb)
+	loaded, err := LoadFromFile(udb.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(loaded.Users); fmt.Sprint(got) != "[alice]" {
+		t.Errorf("users in '%s': %v, want [alice]", udb.Path, got)
+	}
+}
+
+func TestReadFromFileKeepsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "userdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.yml")
+	// a user database of an older version, with a cleartext token
+	old := []byte("users:\n- name: alice\n  apitoken: secret\n  publickey: " + testPublicKey(t) + "\n")
+	err = ioutil.WriteFile(path, old, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	udb, err := ReadFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !udb.APIAuthenticate("alice", "secret") {
+		t.Errorf("token of 'alice' not migrated in memory")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(old) {
+		t.Errorf("ReadFromFile changed '%s' to:\n%s", path, data)
+	}
+
+	_, err = LoadFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) == string(old) {
+		t.Errorf("LoadFromFile did not save the migrated tokens")
+	}
+}
+
+func TestAddInvalidPublicKey(t *testing.T) {
+	udb, dir := newTestDB(t)
+	defer os.RemoveAll(dir)
+	for _, publicKey := range []string{"", "pk", testPublicKey(t) + "x"} {
+		token, err := udb.Add("alice", publicKey)
+		if err != ErrInvalidPublicKey || token != "" {
+			t.Errorf("adding a user with public key '%s': '%s', %v, want %v", publicKey, token, err, ErrInvalidPublicKey)
+		}
+	}
+	if udb.Lookup("alice") {
+		t.Errorf("user with an invalid public key was added")
+	}
+	checkIndex(t, udb)
+}